@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestAPIVersion = 1
+	defaultLogLines   = 100
+
+	actionUpgrade     = "upgrade"
+	actionRollback    = "rollback"
+	actionStatus      = "status"
+	actionRestart     = "restart"
+	actionListBackups = "list-backups"
+	actionGetLogs     = "get-logs"
+	actionCancel      = "cancel"
+
+	errorCodeInvalidRequest        = "invalidRequest"
+	errorCodeUnsupportedAPIVersion = "unsupportedApiVersion"
+	errorCodeUnknownAction         = "unknownAction"
+)
+
+// The handler for an action that can be requested on the request topic
+type requestAction struct {
+	handle func(ctx context.Context, jsonPayload map[string]interface{})
+	//Actions that modify edge run one at a time and publish their progress on the logs topic
+	modifiesEdge bool
+}
+
+var requestActions = map[string]requestAction{
+	actionUpgrade:     {handle: upgradeEdge, modifiesEdge: true},
+	actionRollback:    {handle: rollbackToLatestBackup, modifiesEdge: true},
+	actionRestart:     {handle: restartEdge, modifiesEdge: true},
+	actionStatus:      {handle: getStatus},
+	actionListBackups: {handle: getBackups},
+	actionGetLogs:     {handle: getLogs},
+	actionCancel:      {handle: cancelRequest},
+}
+
+// Parses the request envelope. Requests without an action are upgrade requests, for compatibility
+// with clients that predate the action attribute.
+func parseRequest(payload []byte) (map[string]interface{}, *requestAction, error) {
+	var jsonPayload map[string]interface{}
+
+	if err := json.Unmarshal(payload, &jsonPayload); err != nil || jsonPayload == nil {
+		if err == nil {
+			err = errors.New("payload is not a json object")
+		}
+		log.Printf("[ERROR] parseRequest - Error encountered unmarshalling json: %s\n", err.Error())
+		jsonPayload = map[string]interface{}{"requestId": newRequestId()}
+		addErrorCodeToPayload(jsonPayload, errorCodeInvalidRequest, "Error encountered unmarshalling json: "+err.Error())
+		return jsonPayload, nil, err
+	}
+	log.Printf("[DEBUG] parseRequest - Json payload received: %#v\n", jsonPayload)
+
+	//Identify the request in every response and log message published for it
+	if requestId, ok := jsonPayload["requestId"].(string); !ok || requestId == "" {
+		jsonPayload["requestId"] = newRequestId()
+	}
+	log.Printf("[INFO] parseRequest - Handling request %s\n", jsonPayload["requestId"])
+
+	if jsonPayload["apiVersion"] != nil {
+		if apiVersion, ok := jsonPayload["apiVersion"].(float64); !ok || apiVersion != requestAPIVersion {
+			msg := fmt.Sprintf("Unsupported apiVersion %v, the supported apiVersion is %d", jsonPayload["apiVersion"], requestAPIVersion)
+			addErrorCodeToPayload(jsonPayload, errorCodeUnsupportedAPIVersion, msg)
+			return jsonPayload, nil, errors.New(msg)
+		}
+	}
+
+	actionName := actionUpgrade
+	if jsonPayload["action"] != nil {
+		actionName, _ = jsonPayload["action"].(string)
+	}
+
+	action, ok := requestActions[actionName]
+	if !ok {
+		log.Printf("[ERROR] parseRequest - Unknown action %v\n", jsonPayload["action"])
+		msg := fmt.Sprintf("Unknown action %v, supported actions are %s", jsonPayload["action"], strings.Join(getActionNames(), ", "))
+		addErrorCodeToPayload(jsonPayload, errorCodeUnknownAction, msg)
+		return jsonPayload, nil, errors.New(msg)
+	}
+	return jsonPayload, &action, nil
+}
+
+func getActionNames() []string {
+	return []string{actionUpgrade, actionRollback, actionRestart, actionStatus, actionListBackups, actionGetLogs, actionCancel}
+}
+
+// Stops and starts edge without changing the installed binary
+func restartEdge(ctx context.Context, jsonPayload map[string]interface{}) {
+	if err := commitDeployment(ctx); err != nil {
+		return
+	}
+
+	startJournal(jsonPayload, getInstalledVersion(), nil)
+	defer clearJournal()
+
+	log.Println("[DEBUG] restartEdge - Stopping Edge")
+	if err := stopEdge(); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered stopping edge: "+err.Error())
+		return
+	}
+
+	setDeployPhase(phaseStarting)
+	log.Println("[DEBUG] restartEdge - Starting Edge")
+	if err := startEdge(); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+	} else {
+		setDeployPhase(phaseVerifying)
+		if err = checkEdgeHealth(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered verifying edge health: "+err.Error())
+		}
+	}
+	jsonPayload["runningVersion"] = getInstalledVersion()
+}
+
+// Reports the installed edge version and the environment of the adapter
+func getStatus(ctx context.Context, jsonPayload map[string]interface{}) {
+	jsonPayload["edgeVersion"] = getInstalledVersion()
+	jsonPayload["edgeId"] = edgeId
+	jsonPayload["initSystem"] = initSystem
+	jsonPayload["architecture"] = architecture
+	jsonPayload["os"] = runtime.GOOS
+	jsonPayload["adapterVersion"] = adapterVersion
+
+	processes, err := getEdgeProcesses()
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered retrieving edge process: "+err.Error())
+		return
+	}
+	jsonPayload["edgeRunning"] = len(processes) > 0
+	if len(processes) > 0 {
+		jsonPayload["edgePid"] = processes[0].pid
+	}
+
+	if serviceManager != nil {
+		if active, err := serviceManager.IsActive(); err != nil {
+			log.Printf("[ERROR] getStatus - ERROR retrieving edge service state: %s\n", err.Error())
+		} else {
+			jsonPayload["serviceActive"] = active
+		}
+	}
+}
+
+// Lists the backed up edge binaries available to roll back to, most recent first
+func getBackups(ctx context.Context, jsonPayload map[string]interface{}) {
+	backups, err := listBackups()
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered listing edge backups: "+err.Error())
+		return
+	}
+
+	backupList := make([]map[string]interface{}, 0, len(backups))
+	for _, backup := range backups {
+		backupList = append(backupList, map[string]interface{}{
+			"version": backup.version,
+			"created": backup.created.Format(time.RFC3339),
+			"path":    backup.path,
+		})
+	}
+	jsonPayload["backups"] = backupList
+}
+
+// Returns the logs of the most recent operation that modified edge and the last lines of the adapter
+// log file. The number of lines is specified by the optional lines attribute.
+func getLogs(ctx context.Context, jsonPayload map[string]interface{}) {
+	lines := defaultLogLines
+	if jsonPayload["lines"] != nil {
+		requested, ok := jsonPayload["lines"].(float64)
+		if !ok || requested < 1 {
+			addErrorToPayload(jsonPayload, "The lines attribute must be a positive number")
+			return
+		}
+		lines = int(requested)
+	}
+
+	jsonPayload["logs"] = getDeployLogs()
+
+	contents, err := os.ReadFile(adapterLogFile)
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered reading adapter log file: "+err.Error())
+		return
+	}
+	adapterLogs := strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	if len(adapterLogs) > lines {
+		adapterLogs = adapterLogs[len(adapterLogs)-lines:]
+	}
+	jsonPayload["adapterLogs"] = adapterLogs
+}
+
+// Generates a random ID for requests that do not specify one
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("[ERROR] newRequestId - ERROR generating request ID: %s\n", err.Error())
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+func addErrorCodeToPayload(payload map[string]interface{}, errorCode string, errMsg string) {
+	payload["errorCode"] = errorCode
+	addErrorToPayload(payload, errMsg)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupPrefix         = "edge_"
+	backupTimeFormat     = "20060102T150405"
+	installedVersionFile = "installed_version"
+	unknownEdgeVersion   = "unknown"
+)
+
+var (
+	binaryVersionRegex = regexp.MustCompile(`\d+(\.\d+)+[^\s]*`)
+	//Versions are used in file names, download URLs and image tags
+	edgeVersionRegex = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+-]*$`)
+
+	//The version reported by the installed binary, cached until the binary changes
+	binaryVersion        string
+	binaryVersionModTime time.Time
+	binaryVersionMutex   sync.Mutex
+)
+
+// A copy of a previously installed edge binary, saved before it was replaced
+type edgeBackup struct {
+	path    string
+	version string
+	created time.Time
+}
+
+func edgeBinaryPath() string {
+	return filepath.Join(edgeInstallDir, "edge")
+}
+
+func getBackupDir() string {
+	if backupDir != "" {
+		return backupDir
+	}
+	return filepath.Join(edgeInstallDir, "backups")
+}
+
+// Verifies the requested version cannot escape the backup directory or alter download URLs when it is used in them
+func validateVersion(version string) error {
+	if !edgeVersionRegex.MatchString(version) {
+		return errors.New("The version attribute must start with a letter or digit and contain only letters, digits, '.', '_', '+' and '-'")
+	}
+	return nil
+}
+
+// Returns the version of the installed edge binary, as recorded by the last successful upgrade or,
+// when edge was installed before the adapter was first used, as reported by the binary itself
+func getInstalledVersion() string {
+	version, err := os.ReadFile(filepath.Join(getBackupDir(), installedVersionFile))
+	if err != nil || strings.TrimSpace(string(version)) == "" {
+		return getBinaryVersion(edgeBinaryPath())
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// Runs the binary with --version and returns the version in the first line of its output
+func getBinaryVersion(binary string) string {
+	//Status requests and deployments run concurrently, the binary is only run by one of them
+	binaryVersionMutex.Lock()
+	defer binaryVersionMutex.Unlock()
+
+	info, err := os.Stat(binary)
+	if err != nil {
+		return unknownEdgeVersion
+	}
+	if binaryVersion != "" && info.ModTime().Equal(binaryVersionModTime) {
+		return binaryVersion
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), binaryExecTimeout)
+	defer cancel()
+
+	log.Printf("[DEBUG] getBinaryVersion - Executing command: %s --version\n", binary)
+	output, err := exec.CommandContext(ctx, binary, "--version").CombinedOutput()
+	if err != nil {
+		log.Printf("[ERROR] getBinaryVersion - ERROR retrieving edge version: %s\n", err.Error())
+		return unknownEdgeVersion
+	}
+	version := binaryVersionRegex.FindString(firstLine(string(output)))
+	if version == "" {
+		log.Printf("[ERROR] getBinaryVersion - No version found in the output of %s --version: %s\n", binary, firstLine(string(output)))
+		return unknownEdgeVersion
+	}
+
+	binaryVersion = version
+	binaryVersionModTime = info.ModTime()
+	return version
+}
+
+func setInstalledVersion(version string) {
+	//The backup directory does not exist yet when edge runs in a container
+	if err := os.MkdirAll(getBackupDir(), 0755); err != nil {
+		log.Printf("[ERROR] setInstalledVersion - ERROR creating backup directory: %s\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(getBackupDir(), installedVersionFile), []byte(version+"\n"), 0644); err != nil {
+		log.Printf("[ERROR] setInstalledVersion - ERROR recording installed edge version: %s\n", err.Error())
+	}
+}
+
+// Copies the installed edge binary into the backup directory. The backup name records when the
+// backup was taken and the version that was installed.
+func backupEdge() (*edgeBackup, error) {
+	setDeployPhase(phaseBackingUp)
+	if err := os.MkdirAll(getBackupDir(), 0755); err != nil {
+		return nil, errors.New("Error creating backup directory: " + err.Error())
+	}
+
+	backup := &edgeBackup{version: getInstalledVersion(), created: time.Now()}
+	backup.path = filepath.Join(getBackupDir(), backupPrefix+backup.created.Format(backupTimeFormat)+"_"+backup.version)
+
+	log.Printf("[DEBUG] backupEdge - Copying %s to %s\n", edgeBinaryPath(), backup.path)
+	addLogEntry(fmt.Sprintf("Backing up edge version %s to %s\n", backup.version, backup.path))
+
+	if err := copyFile(edgeBinaryPath(), backup.path); err != nil {
+		log.Printf("[ERROR] backupEdge - ERROR backing up edge: %s\n", err.Error())
+		return nil, errors.New("Error backing up " + edgeBinaryPath() + ": " + err.Error())
+	}
+	return backup, nil
+}
+
+// Atomically replaces the installed edge binary with a backed up edge binary, keeping the owner and
+// mode the backup was taken with
+func restoreEdge(backup *edgeBackup) error {
+	log.Printf("[DEBUG] restoreEdge - Replacing %s with %s\n", edgeBinaryPath(), backup.path)
+	addLogEntry(fmt.Sprintf("Restoring edge version %s from %s\n", backup.version, backup.path))
+
+	uid, gid, mode, err := fileOwnership(backup.path)
+	if err == nil {
+		err = replaceFile(backup.path, edgeBinaryPath(), uid, gid, mode)
+	}
+	if err != nil {
+		log.Printf("[ERROR] restoreEdge - ERROR restoring edge: %s\n", err.Error())
+		return errors.New("Error restoring " + backup.path + ": " + err.Error())
+	}
+	setInstalledVersion(backup.version)
+	return nil
+}
+
+// Restores the backup after a failed upgrade and restarts edge
+func rollbackEdge(backup *edgeBackup) error {
+	addLogEntry(fmt.Sprintf("Rolling back to edge version %s\n", backup.version))
+	setDeployPhase(phaseRollingBack)
+
+	//Edge may or may not be running depending on where the upgrade failed
+	if err := stopEdge(); err != nil {
+		log.Printf("[WARN] rollbackEdge - Unable to stop edge, continuing with rollback: %s\n", err.Error())
+		addLogEvent(logLevelWarn, "Unable to stop edge, continuing with rollback: "+err.Error())
+	}
+	if err := restoreEdge(backup); err != nil {
+		return err
+	}
+	if err := startEdge(); err != nil {
+		return err
+	}
+	if err := checkEdgeHealth(); err != nil {
+		return err
+	}
+
+	addLogEntry(fmt.Sprintf("Rolled back to edge version %s\n", backup.version))
+	return nil
+}
+
+// Returns the edge backups, most recent first
+func listBackups() ([]*edgeBackup, error) {
+	entries, err := os.ReadDir(getBackupDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*edgeBackup{}, nil
+		}
+		return nil, err
+	}
+
+	backups := []*edgeBackup{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), backupPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(entry.Name(), backupPrefix), "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		created, err := time.ParseInLocation(backupTimeFormat, parts[0], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, &edgeBackup{path: filepath.Join(getBackupDir(), entry.Name()), version: parts[1], created: created})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].created.After(backups[j].created)
+	})
+	return backups, nil
+}
+
+// Deletes all but the most recent maxBackups backups
+func pruneBackups() {
+	backups, err := listBackups()
+	if err != nil {
+		log.Printf("[ERROR] pruneBackups - ERROR listing backups: %s\n", err.Error())
+		return
+	}
+	for i := maxBackups; i < len(backups); i++ {
+		log.Printf("[DEBUG] pruneBackups - Deleting backup %s\n", backups[i].path)
+		removeFile(backups[i].path)
+	}
+}
+
+// Handles a rollback request by restoring the most recent backup through the same stop, install
+// and start steps used by upgrades. The restored backup is consumed, so that repeated rollbacks
+// step back through older versions.
+func rollbackToLatestBackup(ctx context.Context, jsonPayload map[string]interface{}) {
+	if initSystem == initSysTypeDocker {
+		addErrorToPayload(jsonPayload, "Rollback is not supported for containerized edge, upgrade to the previous version instead")
+		return
+	}
+
+	backups, err := listBackups()
+	if err != nil {
+		log.Printf("[ERROR] rollbackToLatestBackup - ERROR listing backups: %s\n", err.Error())
+		addErrorToPayload(jsonPayload, "Error encountered listing edge backups: "+err.Error())
+		return
+	}
+	if len(backups) == 0 {
+		log.Println("[ERROR] rollbackToLatestBackup - No edge backups available")
+		addErrorToPayload(jsonPayload, "No edge backups are available to roll back to")
+		return
+	}
+	backup := backups[0]
+
+	//A backup left incomplete, ex. by an earlier version of the adapter, must not replace a working edge
+	if err = checkBinaryExecutes(backup.path); err != nil {
+		log.Printf("[ERROR] rollbackToLatestBackup - Backup %s is not usable: %s\n", backup.path, err.Error())
+		addErrorToPayload(jsonPayload, "Edge backup "+backup.path+" is not usable: "+err.Error())
+		return
+	}
+
+	if err = commitDeployment(ctx); err != nil {
+		return
+	}
+
+	//Keep a copy of the running edge in case the backup does not start
+	current := &edgeBackup{path: filepath.Join(getBackupDir(), "edge.rollback"), version: getInstalledVersion()}
+	log.Printf("[DEBUG] rollbackToLatestBackup - Copying %s to %s\n", edgeBinaryPath(), current.path)
+	if err = copyFile(edgeBinaryPath(), current.path); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered backing up edge: "+err.Error())
+		return
+	}
+	defer removeFile(current.path)
+
+	startJournal(jsonPayload, backup.version, current)
+	defer clearJournal()
+
+	log.Println("[DEBUG] rollbackToLatestBackup - Stopping Edge")
+	if err = stopEdge(); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered stopping edge: "+err.Error())
+		return
+	}
+
+	setDeployPhase(phaseInstalling)
+	log.Printf("[DEBUG] rollbackToLatestBackup - Restoring edge version %s\n", backup.version)
+	if err = restoreEdge(backup); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered restoring edge: "+err.Error())
+	} else {
+		setDeployPhase(phaseStarting)
+		log.Println("[DEBUG] rollbackToLatestBackup - Starting Edge")
+		if err = startEdge(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+		} else {
+			setDeployPhase(phaseVerifying)
+			if err = checkEdgeHealth(); err != nil {
+				addErrorToPayload(jsonPayload, "Error encountered verifying edge health: "+err.Error())
+			}
+		}
+	}
+
+	if err == nil {
+		removeFile(backup.path)
+		jsonPayload["rolledBack"] = true
+		jsonPayload["runningVersion"] = backup.version
+		addLogEntry(fmt.Sprintf("Rolled back to edge version %s\n", backup.version))
+		return
+	}
+
+	//Put back the edge that was running before the rollback
+	log.Printf("[DEBUG] rollbackToLatestBackup - Restoring edge version %s\n", current.version)
+	if err = rollbackEdge(current); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered restoring edge: "+err.Error())
+	} else {
+		jsonPayload["runningVersion"] = current.version
+	}
+}
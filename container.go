@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	initSysTypeDocker       = "docker"
+	previousContainerSuffix = "-previous"
+)
+
+// A ServiceManager for edge running in a docker container named by the containerName flag
+type dockerManager struct {
+	runtime containerRuntime
+}
+
+func newDockerManager() ServiceManager {
+	return &dockerManager{runtime: newDockerClient(dockerSocket)}
+}
+
+func isUsingDocker() bool {
+	if _, err := os.Stat(dockerSocket); err != nil {
+		return false
+	}
+	if _, err := newDockerClient(dockerSocket).InspectContainer(context.Background(), containerName); err != nil {
+		log.Printf("[DEBUG] isUsingDocker - Container %s not found: %s\n", containerName, err.Error())
+		return false
+	}
+	log.Printf("[DEBUG] isUsingDocker - Edge is running in container %s\n", containerName)
+	return true
+}
+
+func (m *dockerManager) Name() string {
+	return initSysTypeDocker
+}
+
+func (m *dockerManager) Start() error {
+	ctx := context.Background()
+	if err := m.restorePreviousContainer(ctx); err != nil {
+		return err
+	}
+
+	addLogEntry(fmt.Sprintf("Starting container %s\n", containerName))
+	if err := m.runtime.StartContainer(ctx, containerName); err != nil {
+		return errors.New("Error starting container " + containerName + ": " + err.Error())
+	}
+	return nil
+}
+
+func (m *dockerManager) Stop() error {
+	addLogEntry(fmt.Sprintf("Stopping container %s\n", containerName))
+	if err := m.runtime.StopContainer(context.Background(), containerName, time.Duration(stopTimeout)*time.Second); err != nil {
+		return errors.New("Error stopping container " + containerName + ": " + err.Error())
+	}
+	return nil
+}
+
+func (m *dockerManager) Restart() error {
+	if err := m.Stop(); err != nil {
+		return err
+	}
+	return m.Start()
+}
+
+func (m *dockerManager) Status() (string, error) {
+	info, err := m.runtime.InspectContainer(context.Background(), containerName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s (%s)", info.State.Status, info.Config["Image"]), nil
+}
+
+func (m *dockerManager) IsActive() (bool, error) {
+	info, err := m.runtime.InspectContainer(context.Background(), containerName)
+	if err != nil {
+		return false, err
+	}
+	return info.State.Running, nil
+}
+
+// Returns the main process of the edge container, when it is running
+func (m *dockerManager) edgeProcesses() ([]edgeProcess, error) {
+	info, err := m.runtime.InspectContainer(context.Background(), containerName)
+	if isNotFound(err) {
+		return []edgeProcess{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.State.Running || info.State.Pid == 0 {
+		return []edgeProcess{}, nil
+	}
+
+	process := edgeProcess{pid: info.State.Pid}
+	if match := edgeIdArgRegex.FindStringSubmatch(strings.Join(append([]string{info.Path}, info.Args...), " ")); match != nil {
+		process.edgeId = match[1]
+	}
+	return []edgeProcess{process}, nil
+}
+
+// Renames the previous container back when the adapter was interrupted after renaming it but before
+// the new container was created
+func (m *dockerManager) restorePreviousContainer(ctx context.Context) error {
+	if _, err := m.runtime.InspectContainer(ctx, containerName); !isNotFound(err) {
+		return nil
+	}
+	previousName := containerName + previousContainerSuffix
+	if _, err := m.runtime.InspectContainer(ctx, previousName); err != nil {
+		return errors.New("Container " + containerName + " does not exist")
+	}
+
+	addLogEntry(fmt.Sprintf("Container %s does not exist, restoring %s\n", containerName, previousName))
+	if err := m.runtime.RenameContainer(ctx, previousName, containerName); err != nil {
+		return errors.New("Error renaming container " + previousName + ": " + err.Error())
+	}
+	return nil
+}
+
+// Upgrades edge running in a container. The image for the requested version is pulled, or loaded from
+// an image archive downloaded like an edge archive, and the container is recreated from it with the
+// same settings. The previous container is kept, stopped, until the new one passes the health check,
+// and is put back if the upgrade fails.
+func upgradeEdgeContainer(ctx context.Context, manager *dockerManager, jsonPayload map[string]interface{}) {
+	version, ok := jsonPayload["version"].(string)
+	if !ok {
+		log.Println("[ERROR] upgradeEdgeContainer - version not specified in incoming payload")
+		addErrorToPayload(jsonPayload, "The version attribute is required")
+		return
+	}
+	if err := validateVersion(version); err != nil {
+		log.Printf("[ERROR] upgradeEdgeContainer - Invalid version in incoming payload: %s\n", version)
+		addErrorToPayload(jsonPayload, err.Error())
+		return
+	}
+
+	current, err := manager.runtime.InspectContainer(ctx, containerName)
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered inspecting container "+containerName+": "+err.Error())
+		return
+	}
+	previousImage, _ := current.Config["Image"].(string)
+
+	image, err := getContainerImage(version, previousImage, jsonPayload)
+	if err != nil {
+		addErrorToPayload(jsonPayload, err.Error())
+		return
+	}
+
+	if err = acquireImage(ctx, manager.runtime, version, image, jsonPayload); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered obtaining image "+image+": "+err.Error())
+		return
+	}
+
+	config, err := recreateConfig(ctx, manager.runtime, current, image)
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered preparing container configuration: "+err.Error())
+		return
+	}
+
+	if err = commitDeployment(ctx); err != nil {
+		return
+	}
+
+	previousVersion := getInstalledVersion()
+	startJournal(jsonPayload, version, nil)
+	setJournalContainer(current.Id, previousImage, previousVersion)
+	defer clearJournal()
+
+	//A previous container left behind by an interrupted upgrade is replaced
+	previousName := containerName + previousContainerSuffix
+	if stale, err := manager.runtime.InspectContainer(ctx, previousName); err == nil && stale.Id != current.Id {
+		log.Printf("[DEBUG] upgradeEdgeContainer - Removing stale container %s\n", previousName)
+		if err = manager.runtime.RemoveContainer(ctx, previousName); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered removing container "+previousName+": "+err.Error())
+			return
+		}
+	}
+
+	log.Println("[DEBUG] upgradeEdgeContainer - Stopping Edge")
+	if err = stopEdge(); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered stopping edge: "+err.Error())
+		return
+	}
+
+	setDeployPhase(phaseInstalling)
+	addLogEntry(fmt.Sprintf("Renaming container %s to %s\n", containerName, previousName))
+	if err = manager.runtime.RenameContainer(ctx, current.Id, previousName); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered renaming container "+containerName+": "+err.Error())
+		if err = startEdge(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered restarting edge: "+err.Error())
+		}
+		return
+	}
+
+	addLogEntry(fmt.Sprintf("Creating container %s from image %s\n", containerName, image))
+	var newId string
+	if newId, err = manager.runtime.CreateContainer(ctx, containerName, config); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered creating container "+containerName+": "+err.Error())
+	} else {
+		setDeployPhase(phaseStarting)
+		log.Println("[DEBUG] upgradeEdgeContainer - Starting Edge")
+		if err = startEdge(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+		} else {
+			setDeployPhase(phaseVerifying)
+			if err = checkEdgeHealth(); err != nil {
+				addErrorToPayload(jsonPayload, "Error encountered verifying edge health: "+err.Error())
+			}
+		}
+	}
+
+	if err == nil {
+		if err = manager.runtime.RemoveContainer(ctx, current.Id); err != nil {
+			log.Printf("[ERROR] upgradeEdgeContainer - ERROR removing container %s: %s\n", previousName, err.Error())
+		}
+		setInstalledVersion(version)
+		jsonPayload["runningVersion"] = version
+		jsonPayload["runningImage"] = image
+		return
+	}
+
+	//Put back the previous container
+	log.Printf("[DEBUG] upgradeEdgeContainer - Rolling back to image %s\n", previousImage)
+	if err = rollbackContainer(ctx, manager, current.Id, newId); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered rolling back edge: "+err.Error())
+	} else {
+		jsonPayload["rolledBack"] = true
+		jsonPayload["runningVersion"] = previousVersion
+		jsonPayload["runningImage"] = previousImage
+	}
+}
+
+// Removes the new container, if it was created, and restores and restarts the previous container
+func rollbackContainer(ctx context.Context, manager *dockerManager, previousId string, newId string) error {
+	addLogEntry(fmt.Sprintf("Rolling back to the previous %s container\n", containerName))
+	setDeployPhase(phaseRollingBack)
+
+	//Edge may or may not be running depending on where the upgrade failed
+	if err := stopEdge(); err != nil {
+		log.Printf("[WARN] rollbackContainer - Unable to stop edge, continuing with rollback: %s\n", err.Error())
+		addLogEvent(logLevelWarn, "Unable to stop edge, continuing with rollback: "+err.Error())
+	}
+
+	if newId != "" {
+		if err := manager.runtime.RemoveContainer(ctx, newId); err != nil {
+			return errors.New("Error removing container " + containerName + ": " + err.Error())
+		}
+	}
+
+	previous, err := manager.runtime.InspectContainer(ctx, previousId)
+	if err != nil {
+		return errors.New("Error inspecting the previous container: " + err.Error())
+	}
+	//The upgrade may have been interrupted before the previous container was renamed
+	if previous.Name != "/"+containerName {
+		addLogEntry(fmt.Sprintf("Renaming container %s to %s\n", strings.TrimPrefix(previous.Name, "/"), containerName))
+		if err = manager.runtime.RenameContainer(ctx, previousId, containerName); err != nil {
+			return errors.New("Error renaming container " + containerName + previousContainerSuffix + ": " + err.Error())
+		}
+	}
+	if err := startEdge(); err != nil {
+		return err
+	}
+	if err := checkEdgeHealth(); err != nil {
+		return err
+	}
+
+	addLogEntry(fmt.Sprintf("Rolled back to the previous %s container\n", containerName))
+	return nil
+}
+
+// Returns the image to upgrade to: the image attribute of the request payload or, by default, the
+// requested version of the containerImage repository or of the repository of the running image
+func getContainerImage(version string, previousImage string, jsonPayload map[string]interface{}) (string, error) {
+	if jsonPayload["image"] != nil {
+		image, ok := jsonPayload["image"].(string)
+		if !ok || image == "" {
+			return "", errors.New("The image attribute must be a string")
+		}
+		return image, nil
+	}
+
+	repository := containerImage
+	if repository == "" {
+		repository = imageRepository(previousImage)
+	}
+	if repository == "" {
+		return "", errors.New("Unable to determine the edge image repository, specify the containerImage flag")
+	}
+	return repository + ":" + version, nil
+}
+
+// Strips the tag and digest from an image reference. A registry host may contain a port, so only a
+// colon after the last slash starts a tag.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// Loads the image from the archive named by the imageArchive attribute of the request payload, verified
+// like edge archives, or otherwise pulls it. An image already present is used if it cannot be pulled.
+func acquireImage(ctx context.Context, runtime containerRuntime, version string, image string, jsonPayload map[string]interface{}) error {
+	setDeployPhase(phaseDownloading)
+
+	if jsonPayload["imageArchive"] != nil {
+		archiveName, ok := jsonPayload["imageArchive"].(string)
+		if !ok || archiveName == "" || filepath.Base(archiveName) != archiveName {
+			return errors.New("The imageArchive attribute must be a file name")
+		}
+		sources, err := getArtifactSources(version, jsonPayload)
+		if err != nil {
+			return err
+		}
+
+		archiveFile := filepath.Join(stagingDir, archiveName)
+		defer removeDownload(archiveFile)
+
+		addLogEntry(fmt.Sprintf("Downloading image archive %s\n", archiveName))
+		source, err := downloadArtifact(ctx, sources, archiveName, archiveFile)
+		if err != nil {
+			return err
+		}
+		if err = verifyChecksum(ctx, source, jsonPayload, archiveName, archiveFile); err != nil {
+			return err
+		}
+		if err = verifySignature(ctx, source, jsonPayload, archiveName, archiveFile); err != nil {
+			return err
+		}
+
+		addLogEntry(fmt.Sprintf("Loading image archive %s\n", archiveName))
+		if err = runtime.LoadImage(ctx, archiveFile); err != nil {
+			return err
+		}
+	} else {
+		addLogEntry(fmt.Sprintf("Pulling image %s\n", image))
+		if err := runtime.PullImage(ctx, image); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("[WARN] acquireImage - Unable to pull %s: %s\n", image, err.Error())
+			addLogEvent(logLevelWarn, fmt.Sprintf("Unable to pull image %s, using the local image if present: %s\n", image, err.Error()))
+		}
+	}
+
+	if _, err := runtime.InspectImage(ctx, image); err != nil {
+		return errors.New("Image " + image + " is not available: " + err.Error())
+	}
+	addLogEntry(fmt.Sprintf("Image %s is available\n", image))
+	return nil
+}
+
+// Builds the configuration of the new container from the inspected container. Settings that were
+// inherited from the previous image, rather than set on the container, are dropped so that the new
+// image's defaults apply.
+func recreateConfig(ctx context.Context, runtime containerRuntime, current *containerInfo, image string) (map[string]interface{}, error) {
+	config := make(map[string]interface{}, len(current.Config)+2)
+	for key, value := range current.Config {
+		config[key] = value
+	}
+	config["Image"] = image
+
+	if previousImage, err := runtime.InspectImage(ctx, current.Image); err != nil {
+		log.Printf("[WARN] recreateConfig - Unable to inspect the previous image, keeping all settings: %s\n", err.Error())
+	} else if previousImage.Config != nil {
+		for _, key := range []string{"Cmd", "Entrypoint", "WorkingDir", "User", "ExposedPorts", "Volumes", "StopSignal", "Healthcheck"} {
+			if reflect.DeepEqual(config[key], previousImage.Config[key]) {
+				delete(config, key)
+			}
+		}
+		config["Env"] = withoutInherited(config["Env"], previousImage.Config["Env"])
+		config["Labels"] = withoutInheritedLabels(config["Labels"], previousImage.Config["Labels"])
+	}
+
+	config["HostConfig"] = current.HostConfig
+
+	//Only one network can be connected when a container is created, the one the container runs in
+	networkMode, _ := current.HostConfig["NetworkMode"].(string)
+	if endpoint, ok := current.NetworkSettings.Networks[networkMode]; ok {
+		settings := map[string]interface{}{}
+		for _, key := range []string{"IPAMConfig", "Links", "Aliases", "DriverOpts"} {
+			if endpoint[key] != nil {
+				settings[key] = endpoint[key]
+			}
+		}
+		config["NetworkingConfig"] = map[string]interface{}{
+			"EndpointsConfig": map[string]interface{}{networkMode: settings},
+		}
+	}
+	if len(current.NetworkSettings.Networks) > 1 {
+		log.Printf("[WARN] recreateConfig - Container %s is connected to %d networks, only %s is kept\n", containerName, len(current.NetworkSettings.Networks), networkMode)
+	}
+	return config, nil
+}
+
+// Returns the entries of values, a JSON array of strings, not present in inherited
+func withoutInherited(values interface{}, inherited interface{}) interface{} {
+	list, ok := values.([]interface{})
+	inheritedList, _ := inherited.([]interface{})
+	if !ok || len(inheritedList) == 0 {
+		return values
+	}
+
+	result := []interface{}{}
+	for _, value := range list {
+		found := false
+		for _, inheritedValue := range inheritedList {
+			if value == inheritedValue {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Returns the labels, a JSON object, whose values differ from the inherited labels
+func withoutInheritedLabels(labels interface{}, inherited interface{}) interface{} {
+	labelMap, ok := labels.(map[string]interface{})
+	inheritedMap, _ := inherited.(map[string]interface{})
+	if !ok || len(inheritedMap) == 0 {
+		return labels
+	}
+
+	result := map[string]interface{}{}
+	for key, value := range labelMap {
+		if inheritedValue, found := inheritedMap[key]; !found || inheritedValue != value {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// Finishes or rolls back a container upgrade interrupted by an adapter crash or a reboot. The new container
+// is kept if it had been started and passes the health check, otherwise the previous container recorded in
+// the journal is put back.
+func finishInterruptedContainerUpgrade(manager *dockerManager, journal *deploymentJournal, jsonPayload map[string]interface{}) {
+	ctx := context.Background()
+
+	var newId string
+	if existing, err := manager.runtime.InspectContainer(ctx, containerName); err == nil && existing.Id != journal.PreviousContainerId {
+		newId = existing.Id
+	}
+
+	//The new container was created, it only needs to be started
+	if newId != "" && (journal.Phase == phaseStarting || journal.Phase == phaseVerifying) {
+		err := startEdgeIfStopped()
+		if err == nil {
+			setDeployPhase(phaseVerifying)
+			err = checkEdgeHealth()
+		}
+		if err == nil {
+			if err = manager.runtime.RemoveContainer(ctx, journal.PreviousContainerId); err != nil && !isNotFound(err) {
+				log.Printf("[ERROR] finishInterruptedContainerUpgrade - ERROR removing the previous container: %s\n", err.Error())
+			}
+			setInstalledVersion(journal.TargetVersion)
+			jsonPayload["runningVersion"] = journal.TargetVersion
+			addLogEntry(fmt.Sprintf("Recovered request %s, edge version %s is running\n", journal.RequestId, journal.TargetVersion))
+			return
+		}
+		addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+	}
+
+	if err := rollbackContainer(ctx, manager, journal.PreviousContainerId, newId); err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered rolling back edge: "+err.Error())
+		return
+	}
+	jsonPayload["rolledBack"] = true
+	jsonPayload["runningVersion"] = journal.BackupVersion
+	jsonPayload["runningImage"] = journal.PreviousImage
+}
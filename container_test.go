@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-memory containerRuntime. Containers run the edge ID of their Cmd and can be made to fail.
+type fakeRuntime struct {
+	mutex      sync.Mutex
+	containers map[string]*fakeContainer
+	images     map[string]*imageInfo
+	nextId     int
+	nextPid    int
+
+	createError error           //Returned by CreateContainer
+	crashing    map[string]bool //Images whose containers exit right after starting
+	calls       []string
+}
+
+type fakeContainer struct {
+	info     containerInfo
+	crashing bool
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{
+		containers: map[string]*fakeContainer{},
+		images:     map[string]*imageInfo{},
+		nextPid:    100,
+		crashing:   map[string]bool{},
+	}
+}
+
+func (f *fakeRuntime) addImage(ref string, config map[string]interface{}) {
+	f.images[ref] = &imageInfo{Id: "sha256:" + ref, RepoTags: []string{ref}, Config: config}
+}
+
+// Adds a container, started, as created by docker run
+func (f *fakeRuntime) addContainer(name string, config map[string]interface{}, hostConfig map[string]interface{}) string {
+	f.nextId++
+	id := fmt.Sprintf("container%d", f.nextId)
+	image := f.images[config["Image"].(string)]
+	container := &fakeContainer{info: containerInfo{Id: id, Name: "/" + name, Image: image.Id, Config: config, HostConfig: hostConfig}}
+	f.containers[id] = container
+	f.start(container)
+	return id
+}
+
+// Finds a container by ID or by name, like the Docker Engine API
+func (f *fakeRuntime) find(nameOrId string) (*fakeContainer, error) {
+	if container, ok := f.containers[nameOrId]; ok {
+		return container, nil
+	}
+	for _, container := range f.containers {
+		if container.info.Name == "/"+nameOrId {
+			return container, nil
+		}
+	}
+	return nil, &dockerError{statusCode: http.StatusNotFound, message: "No such container: " + nameOrId}
+}
+
+func (f *fakeRuntime) start(container *fakeContainer) {
+	cmd, ok := container.info.Config["Cmd"].([]interface{})
+	if !ok {
+		for _, image := range f.images {
+			if image.Id == container.info.Image {
+				cmd, _ = image.Config["Cmd"].([]interface{})
+			}
+		}
+	}
+	container.info.Path = "/usr/bin/clearblade/edge"
+	container.info.Args = []string{}
+	for _, arg := range cmd {
+		container.info.Args = append(container.info.Args, arg.(string))
+	}
+
+	f.nextPid++
+	container.info.State.Status = "running"
+	container.info.State.Running = true
+	container.info.State.Pid = f.nextPid
+}
+
+func (f *fakeRuntime) record(call string) {
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeRuntime) InspectContainer(ctx context.Context, name string) (*containerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	container, err := f.find(name)
+	if err != nil {
+		return nil, err
+	}
+	info := container.info
+
+	//A crashing container is seen running once, then exits
+	if container.crashing && container.info.State.Running {
+		container.crashing = false
+		container.info.State.Status = "exited"
+		container.info.State.Running = false
+		container.info.State.Pid = 0
+	}
+	return &info, nil
+}
+
+func (f *fakeRuntime) InspectImage(ctx context.Context, image string) (*imageInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for ref, info := range f.images {
+		if ref == image || info.Id == image {
+			return info, nil
+		}
+	}
+	return nil, &dockerError{statusCode: http.StatusNotFound, message: "No such image: " + image}
+}
+
+func (f *fakeRuntime) PullImage(ctx context.Context, image string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record("pull " + image)
+	if _, ok := f.images[image]; !ok {
+		return &dockerError{statusCode: http.StatusNotFound, message: "manifest unknown"}
+	}
+	return nil
+}
+
+func (f *fakeRuntime) LoadImage(ctx context.Context, archive string) error {
+	return errors.New("LoadImage is not supported")
+}
+
+func (f *fakeRuntime) CreateContainer(ctx context.Context, name string, config map[string]interface{}) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record("create " + name)
+	if f.createError != nil {
+		return "", f.createError
+	}
+	if _, err := f.find(name); err == nil {
+		return "", &dockerError{statusCode: http.StatusConflict, message: "Conflict. The container name is already in use"}
+	}
+	image, ok := f.images[config["Image"].(string)]
+	if !ok {
+		return "", &dockerError{statusCode: http.StatusNotFound, message: "No such image"}
+	}
+
+	containerConfig := map[string]interface{}{}
+	for key, value := range config {
+		if key != "HostConfig" && key != "NetworkingConfig" {
+			containerConfig[key] = value
+		}
+	}
+	hostConfig, _ := config["HostConfig"].(map[string]interface{})
+
+	f.nextId++
+	id := fmt.Sprintf("container%d", f.nextId)
+	container := &fakeContainer{info: containerInfo{Id: id, Name: "/" + name, Image: image.Id, Config: containerConfig, HostConfig: hostConfig}}
+	container.info.State.Status = "created"
+	f.containers[id] = container
+	return id, nil
+}
+
+func (f *fakeRuntime) StartContainer(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	container, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	f.record("start " + strings.TrimPrefix(container.info.Name, "/"))
+	if !container.info.State.Running {
+		f.start(container)
+		container.crashing = f.crashing[container.info.Config["Image"].(string)]
+	}
+	return nil
+}
+
+func (f *fakeRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	container, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	f.record("stop " + strings.TrimPrefix(container.info.Name, "/"))
+	container.info.State.Status = "exited"
+	container.info.State.Running = false
+	container.info.State.Pid = 0
+	return nil
+}
+
+func (f *fakeRuntime) RenameContainer(ctx context.Context, id string, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	container, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if existing, err := f.find(name); err == nil && existing != container {
+		return &dockerError{statusCode: http.StatusConflict, message: "Conflict. The container name is already in use"}
+	}
+	f.record("rename " + strings.TrimPrefix(container.info.Name, "/") + " " + name)
+	container.info.Name = "/" + name
+	return nil
+}
+
+func (f *fakeRuntime) RemoveContainer(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	container, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if container.info.State.Running {
+		return &dockerError{statusCode: http.StatusConflict, message: "You cannot remove a running container"}
+	}
+	f.record("remove " + strings.TrimPrefix(container.info.Name, "/"))
+	delete(f.containers, container.info.Id)
+	return nil
+}
+
+// Sets up edge version 4.0 running in container edge, managed by a dockerManager using the fake runtime
+func setupContainerTest(t *testing.T) (*fakeRuntime, *dockerManager, string) {
+	t.Helper()
+
+	savedContainerName, savedContainerImage, savedEdgeId := containerName, containerImage, edgeId
+	savedStateDir, savedBackupDir, savedEdgeInstallDir := stateDir, backupDir, edgeInstallDir
+	savedHealthCheckDuration, savedHealthCheckURL := healthCheckDuration, healthCheckURL
+	savedStopTimeout, savedStartTimeout := stopTimeout, startTimeout
+	savedServiceManager, savedInitSystem := serviceManager, initSystem
+	t.Cleanup(func() {
+		containerName, containerImage, edgeId = savedContainerName, savedContainerImage, savedEdgeId
+		stateDir, backupDir, edgeInstallDir = savedStateDir, savedBackupDir, savedEdgeInstallDir
+		healthCheckDuration, healthCheckURL = savedHealthCheckDuration, savedHealthCheckURL
+		stopTimeout, startTimeout = savedStopTimeout, savedStartTimeout
+		serviceManager, initSystem = savedServiceManager, savedInitSystem
+		clearJournal()
+	})
+
+	containerName = "edge"
+	containerImage = ""
+	edgeId = "edge1"
+	stateDir = t.TempDir()
+	backupDir = t.TempDir()
+	edgeInstallDir = t.TempDir()
+	healthCheckDuration = 0
+	healthCheckURL = ""
+	stopTimeout = 0
+	startTimeout = 0
+
+	runtime := newFakeRuntime()
+	imageConfig := map[string]interface{}{
+		"Cmd":        []interface{}{"-edge-id=default"},
+		"Env":        []interface{}{"PATH=/usr/bin"},
+		"WorkingDir": "/usr/bin/clearblade",
+		"Labels":     map[string]interface{}{"version": "4.0"},
+	}
+	runtime.addImage("clearblade/edge:4.0", imageConfig)
+	runtime.addImage("clearblade/edge:4.1", map[string]interface{}{
+		"Cmd":        []interface{}{"-edge-id=default"},
+		"Env":        []interface{}{"PATH=/usr/bin"},
+		"WorkingDir": "/usr/bin/clearblade",
+		"Labels":     map[string]interface{}{"version": "4.1"},
+	})
+	id := runtime.addContainer(containerName, map[string]interface{}{
+		"Image":      "clearblade/edge:4.0",
+		"Cmd":        []interface{}{"-edge-id=edge1", "-novi-ip=platform.example.com"},
+		"Env":        []interface{}{"PATH=/usr/bin", "EDGE_LOG_LEVEL=debug"},
+		"WorkingDir": "/usr/bin/clearblade",
+		"Labels":     map[string]interface{}{"version": "4.0"},
+	}, map[string]interface{}{
+		"NetworkMode":   "host",
+		"RestartPolicy": map[string]interface{}{"Name": "unless-stopped"},
+	})
+
+	manager := &dockerManager{runtime: runtime}
+	serviceManager = manager
+	initSystem = initSysTypeDocker
+	setInstalledVersion("4.0")
+	startDeployLog("test")
+	return runtime, manager, id
+}
+
+func TestUpgradeEdgeContainer(t *testing.T) {
+	runtime, manager, previousId := setupContainerTest(t)
+	previous := runtime.containers[previousId].info
+
+	jsonPayload := map[string]interface{}{"requestId": "test", "version": "4.1"}
+	upgradeEdgeContainer(context.Background(), manager, jsonPayload)
+
+	if jsonPayload["error"] != nil {
+		t.Fatalf("upgrade failed: %v", jsonPayload["error"])
+	}
+	if jsonPayload["runningVersion"] != "4.1" || jsonPayload["runningImage"] != "clearblade/edge:4.1" {
+		t.Errorf("running %v (%v), expected 4.1 (clearblade/edge:4.1)", jsonPayload["runningVersion"], jsonPayload["runningImage"])
+	}
+	if version := getInstalledVersion(); version != "4.1" {
+		t.Errorf("installed version %s, expected 4.1", version)
+	}
+
+	expectedCalls := []string{"pull clearblade/edge:4.1", "stop edge", "rename edge edge-previous", "create edge", "start edge", "remove edge-previous"}
+	if !reflect.DeepEqual(runtime.calls, expectedCalls) {
+		t.Errorf("calls %v, expected %v", runtime.calls, expectedCalls)
+	}
+
+	if _, ok := runtime.containers[previousId]; ok {
+		t.Error("the previous container was not removed")
+	}
+	if len(runtime.containers) != 1 {
+		t.Fatalf("%d containers, expected 1", len(runtime.containers))
+	}
+	current, err := runtime.find(containerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.info.State.Running {
+		t.Error("the new container is not running")
+	}
+	if image := current.info.Config["Image"]; image != "clearblade/edge:4.1" {
+		t.Errorf("new container image %v, expected clearblade/edge:4.1", image)
+	}
+	if !reflect.DeepEqual(current.info.Config["Cmd"], previous.Config["Cmd"]) {
+		t.Errorf("new container Cmd %v, expected %v", current.info.Config["Cmd"], previous.Config["Cmd"])
+	}
+	if !reflect.DeepEqual(current.info.Config["Env"], []interface{}{"EDGE_LOG_LEVEL=debug"}) {
+		t.Errorf("new container Env %v, expected the variables set on the container", current.info.Config["Env"])
+	}
+	if !reflect.DeepEqual(current.info.HostConfig, previous.HostConfig) {
+		t.Errorf("new container HostConfig %v, expected %v", current.info.HostConfig, previous.HostConfig)
+	}
+	if journal, err := readJournal(); err != nil || journal != nil {
+		t.Errorf("journal %v (%v), expected it to be cleared", journal, err)
+	}
+}
+
+func TestUpgradeEdgeContainerRollback(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(runtime *fakeRuntime)
+		error         string
+		expectedCalls []string
+	}{
+		{
+			name:          "create fails",
+			setup:         func(runtime *fakeRuntime) { runtime.createError = errors.New("no space left on device") },
+			error:         "Error encountered creating container edge",
+			expectedCalls: []string{"pull clearblade/edge:4.1", "stop edge", "rename edge edge-previous", "create edge", "rename edge-previous edge", "start edge"},
+		},
+		{
+			name:          "health check fails",
+			setup:         func(runtime *fakeRuntime) { runtime.crashing["clearblade/edge:4.1"] = true },
+			error:         "Error encountered verifying edge health",
+			expectedCalls: []string{"pull clearblade/edge:4.1", "stop edge", "rename edge edge-previous", "create edge", "start edge", "stop edge", "remove edge", "rename edge-previous edge", "start edge"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runtime, manager, previousId := setupContainerTest(t)
+			test.setup(runtime)
+
+			jsonPayload := map[string]interface{}{"requestId": "test", "version": "4.1"}
+			upgradeEdgeContainer(context.Background(), manager, jsonPayload)
+
+			if message, _ := jsonPayload["error"].(string); !strings.Contains(message, test.error) {
+				t.Errorf("error %q, expected %q", message, test.error)
+			}
+			if jsonPayload["rolledBack"] != true || jsonPayload["runningVersion"] != "4.0" || jsonPayload["runningImage"] != "clearblade/edge:4.0" {
+				t.Errorf("rolledBack %v running %v (%v), expected a rollback to 4.0 (clearblade/edge:4.0)", jsonPayload["rolledBack"], jsonPayload["runningVersion"], jsonPayload["runningImage"])
+			}
+			if version := getInstalledVersion(); version != "4.0" {
+				t.Errorf("installed version %s, expected 4.0", version)
+			}
+			if !reflect.DeepEqual(runtime.calls, test.expectedCalls) {
+				t.Errorf("calls %v, expected %v", runtime.calls, test.expectedCalls)
+			}
+
+			if len(runtime.containers) != 1 {
+				t.Fatalf("%d containers, expected only the previous container", len(runtime.containers))
+			}
+			previous, ok := runtime.containers[previousId]
+			if !ok {
+				t.Fatal("the previous container was removed")
+			}
+			if previous.info.Name != "/"+containerName || !previous.info.State.Running {
+				t.Errorf("previous container %s running %t, expected /%s running", previous.info.Name, previous.info.State.Running, containerName)
+			}
+		})
+	}
+}
+
+func TestRestorePreviousContainer(t *testing.T) {
+	runtime, manager, previousId := setupContainerTest(t)
+
+	//Interrupted after the container was stopped and renamed, before the new one was created
+	ctx := context.Background()
+	if err := runtime.StopContainer(ctx, containerName, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.RenameContainer(ctx, containerName, containerName+previousContainerSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	previous := runtime.containers[previousId]
+	if previous.info.Name != "/"+containerName || !previous.info.State.Running {
+		t.Errorf("previous container %s running %t, expected /%s running", previous.info.Name, previous.info.State.Running, containerName)
+	}
+
+	//Nothing to restore from
+	if err := runtime.StopContainer(ctx, containerName, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.RemoveContainer(ctx, containerName); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Start(); err == nil {
+		t.Error("starting a container that does not exist succeeded")
+	}
+}
+
+func TestFinishInterruptedContainerUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		phase      string
+		crashing   bool
+		rolledBack bool
+		version    string
+	}{
+		{name: "interrupted while verifying", phase: phaseVerifying, version: "4.1"},
+		{name: "unhealthy after the interruption", phase: phaseVerifying, crashing: true, rolledBack: true, version: "4.0"},
+		{name: "interrupted while installing", phase: phaseInstalling, rolledBack: true, version: "4.0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runtime, _, previousId := setupContainerTest(t)
+			runtime.crashing["clearblade/edge:4.1"] = test.crashing
+
+			//Interrupted once the new container was created
+			ctx := context.Background()
+			if err := runtime.StopContainer(ctx, containerName, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := runtime.RenameContainer(ctx, containerName, containerName+previousContainerSuffix); err != nil {
+				t.Fatal(err)
+			}
+			config, err := recreateConfig(ctx, runtime, &runtime.containers[previousId].info, "clearblade/edge:4.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = runtime.CreateContainer(ctx, containerName, config); err != nil {
+				t.Fatal(err)
+			}
+
+			journal := &deploymentJournal{
+				RequestId:           "test",
+				Request:             map[string]interface{}{"requestId": "test", "version": "4.1"},
+				EdgeId:              edgeId,
+				TargetVersion:       "4.1",
+				BackupVersion:       "4.0",
+				PreviousContainerId: previousId,
+				PreviousImage:       "clearblade/edge:4.0",
+				Phase:               test.phase,
+			}
+			jsonPayload := journal.Request
+			finishInterruptedDeployment(journal, jsonPayload)
+
+			if jsonPayload["runningVersion"] != test.version {
+				t.Errorf("running %v, expected %s (error %v)", jsonPayload["runningVersion"], test.version, jsonPayload["error"])
+			}
+			if version := getInstalledVersion(); version != test.version {
+				t.Errorf("installed version %s, expected %s", version, test.version)
+			}
+			if rolledBack := jsonPayload["rolledBack"] == true; rolledBack != test.rolledBack {
+				t.Errorf("rolledBack %t, expected %t", rolledBack, test.rolledBack)
+			}
+			if _, ok := runtime.containers[previousId]; ok == !test.rolledBack {
+				t.Errorf("previous container kept %t, expected %t", ok, test.rolledBack)
+			}
+			if len(runtime.containers) != 1 {
+				t.Errorf("%d containers, expected 1", len(runtime.containers))
+			}
+			if journal, err := readJournal(); err != nil || journal != nil {
+				t.Errorf("journal %v (%v), expected it to be cleared", journal, err)
+			}
+		})
+	}
+}
+
+func TestRecreateConfig(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.addImage("clearblade/edge:4.0", map[string]interface{}{
+		"Cmd":          []interface{}{"-edge-id=default"},
+		"Entrypoint":   []interface{}{"/usr/bin/clearblade/edge"},
+		"WorkingDir":   "/usr/bin/clearblade",
+		"ExposedPorts": map[string]interface{}{"9000/tcp": map[string]interface{}{}},
+		"Env":          []interface{}{"PATH=/usr/bin", "EDGE_VERSION=4.0"},
+		"Labels":       map[string]interface{}{"version": "4.0", "vendor": "ClearBlade"},
+	})
+	current := &containerInfo{
+		Id:    "container1",
+		Image: "sha256:clearblade/edge:4.0",
+		Config: map[string]interface{}{
+			"Image":        "clearblade/edge:4.0",
+			"Hostname":     "gateway",
+			"Cmd":          []interface{}{"-edge-id=edge1"},
+			"Entrypoint":   []interface{}{"/usr/bin/clearblade/edge"},
+			"WorkingDir":   "/usr/bin/clearblade",
+			"ExposedPorts": map[string]interface{}{"9000/tcp": map[string]interface{}{}},
+			"Env":          []interface{}{"PATH=/usr/bin", "EDGE_VERSION=4.0", "EDGE_LOG_LEVEL=debug"},
+			"Labels":       map[string]interface{}{"version": "4.0", "vendor": "ClearBlade", "site": "plant1"},
+		},
+		HostConfig: map[string]interface{}{"NetworkMode": "edge-net", "Binds": []interface{}{"/var/lib/edge:/data"}},
+	}
+	current.NetworkSettings.Networks = map[string]map[string]interface{}{
+		"edge-net": {"Aliases": []interface{}{"edge"}, "IPAddress": "172.18.0.2", "NetworkID": "net1"},
+	}
+
+	config, err := recreateConfig(context.Background(), runtime, current, "clearblade/edge:4.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"Image":      "clearblade/edge:4.1",
+		"Hostname":   "gateway",
+		"Cmd":        []interface{}{"-edge-id=edge1"},
+		"Env":        []interface{}{"EDGE_LOG_LEVEL=debug"},
+		"Labels":     map[string]interface{}{"site": "plant1"},
+		"HostConfig": current.HostConfig,
+		"NetworkingConfig": map[string]interface{}{
+			"EndpointsConfig": map[string]interface{}{
+				"edge-net": map[string]interface{}{"Aliases": []interface{}{"edge"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("config %v, expected %v", config, expected)
+	}
+	if current.Config["Image"] != "clearblade/edge:4.0" {
+		t.Error("the inspected container configuration was modified")
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"clearblade/edge:4.0", "clearblade/edge"},
+		{"clearblade/edge", "clearblade/edge"},
+		{"edge", "edge"},
+		{"registry.example.com:5000/clearblade/edge:4.0", "registry.example.com:5000/clearblade/edge"},
+		{"registry.example.com:5000/clearblade/edge", "registry.example.com:5000/clearblade/edge"},
+		{"clearblade/edge@sha256:4a5b6c", "clearblade/edge"},
+		{"registry.example.com:5000/clearblade/edge:4.0@sha256:4a5b6c", "registry.example.com:5000/clearblade/edge"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if repository := imageRepository(test.image); repository != test.expected {
+			t.Errorf("imageRepository(%q) = %q, expected %q", test.image, repository, test.expected)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+
+	phaseReceived         = "received"
+	phaseDownloading      = "downloading"
+	phaseVerifyingArchive = "verifyingArchive"
+	phasePreflight        = "preflight"
+	phaseBackingUp        = "backingUp"
+	phaseStopping         = "stopping"
+	phaseInstalling       = "installing"
+	phaseStarting         = "starting"
+	phaseVerifying        = "verifying"
+	phaseRollingBack      = "rollingBack"
+)
+
+// A log message published on the logs topic while a request modifies edge
+type logEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Phase     string    `json:"phase"`
+	Step      int       `json:"step"`
+	Message   string    `json:"message"`
+	RequestId string    `json:"requestId"`
+	//Only present in download progress events
+	Progress *downloadProgress `json:"progress,omitempty"`
+}
+
+var (
+	deployLogs      []logEvent
+	deployPhase     string
+	deployLogsMutex sync.Mutex
+)
+
+// Clears the log events of the previous request
+func startDeployLog(requestId string) {
+	deployLogsMutex.Lock()
+	defer deployLogsMutex.Unlock()
+
+	deployRequestId = requestId
+	deployPhase = phaseReceived
+	deployLogs = make([]logEvent, 0)
+}
+
+// Records the phase the active request is entering, in the log events and the deployment journal
+func setDeployPhase(phase string) {
+	deployLogsMutex.Lock()
+	deployPhase = phase
+	deployLogsMutex.Unlock()
+
+	setJournalPhase(phase)
+}
+
+// Returns true if payload is the request of the active, or most recent, deployment
+func isDeployRequest(payload map[string]interface{}) bool {
+	deployLogsMutex.Lock()
+	defer deployLogsMutex.Unlock()
+
+	requestId, ok := payload["requestId"].(string)
+	return ok && requestId != "" && requestId == deployRequestId
+}
+
+// Returns a copy of the log events of the most recent request that modified edge
+func getDeployLogs() []logEvent {
+	deployLogsMutex.Lock()
+	defer deployLogsMutex.Unlock()
+
+	return append([]logEvent{}, deployLogs...)
+}
+
+func addLogEntry(msg string) {
+	addLogEvent(logLevelInfo, msg)
+}
+
+// Records a log event for the active request and publishes it on the logs topic
+func addLogEvent(level string, msg string) {
+	publishLogEvent(logEvent{Level: level, Message: msg})
+}
+
+// Records a download progress event for the active request and publishes it on the logs topic
+func addProgressEvent(msg string, progress *downloadProgress) {
+	publishLogEvent(logEvent{Level: logLevelInfo, Message: msg, Progress: progress})
+}
+
+func publishLogEvent(event logEvent) {
+	deployLogsMutex.Lock()
+	event.Timestamp = time.Now().UTC()
+	event.Phase = deployPhase
+	event.Step = len(deployLogs) + 1
+	event.Message = strings.TrimRight(event.Message, "\n")
+	event.RequestId = deployRequestId
+	deployLogs = append(deployLogs, event)
+
+	//Publish the new event by itself, or with every event of the request when publishLogHistory is set
+	var logsPayload interface{} = event
+	if publishLogHistory {
+		logsPayload = map[string]interface{}{
+			"requestId": deployRequestId,
+			"logs":      append([]logEvent{}, deployLogs...),
+		}
+	}
+	deployLogsMutex.Unlock()
+
+	publishLogs(logsPayload)
+}
+
+func publishLogs(logsPayload interface{}) {
+	//Create the response topic
+	theTopic := topicRoot + "/" + edgeId + "/logs"
+
+	logsStr, err := json.Marshal(logsPayload)
+	if err != nil {
+		log.Printf("[ERROR] publishLogs - ERROR marshalling json response: %s\n", err.Error())
+	} else {
+		log.Printf("[DEBUG] publishLogs - Publishing logs %s to topic %s\n", string(logsStr), theTopic)
+
+		//Publish the logs
+		err = publish(theTopic, string(logsStr))
+		if err != nil {
+			log.Printf("[ERROR] publishLogs - ERROR publishing to topic: %s\n", err.Error())
+		}
+	}
+}
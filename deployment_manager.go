@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	concurrencyPolicyReject = "reject"
+	concurrencyPolicyQueue  = "queue"
+	errorCodeBusy           = "busy"
+	errorCodeNotFound       = "notFound"
+
+	cancelOutcomeDequeued   = "dequeued"
+	cancelOutcomeAborted    = "aborted"
+	cancelOutcomeCompleting = "completing"
+)
+
+// A request for an action that modifies edge
+type deployment struct {
+	requestId   string
+	payload     []byte
+	jsonPayload map[string]interface{}
+	action      *requestAction
+	ctx         context.Context
+	cancel      context.CancelFunc
+	//Set once edge is about to be stopped, after which the deployment can no longer be cancelled
+	committed bool
+}
+
+// Ensures only one action that modifies edge runs at a time. Requests received while a deployment
+// is in progress are rejected or queued, depending on the concurrencyPolicy flag.
+type deploymentManager struct {
+	mutex  sync.Mutex
+	active *deployment
+	queue  []*deployment
+}
+
+var deployments = &deploymentManager{}
+
+// Starts the deployment, or queues it or rejects it with a busy response if another deployment is in progress
+func (m *deploymentManager) submit(d *deployment) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	if m.active == nil {
+		m.active = d
+		go m.run(d)
+		return
+	}
+
+	if concurrencyPolicy == concurrencyPolicyQueue && len(m.queue) < maxQueuedRequests {
+		log.Printf("[INFO] deploymentManager.submit - Request %s queued behind request %s\n", d.requestId, m.active.requestId)
+		m.queue = append(m.queue, d)
+		return
+	}
+
+	log.Printf("[INFO] deploymentManager.submit - Rejecting request %s, request %s is in progress\n", d.requestId, m.active.requestId)
+	d.jsonPayload["busy"] = true
+	d.jsonPayload["activeRequestId"] = m.active.requestId
+	addErrorCodeToPayload(d.jsonPayload, errorCodeBusy, fmt.Sprintf("Request %s is in progress, try again once it completes", m.active.requestId))
+	d.cancel()
+	go publishResult(d.jsonPayload)
+}
+
+// Runs the deployment followed by any queued deployments
+func (m *deploymentManager) run(d *deployment) {
+	for d != nil {
+		deployEdge(d)
+		d.cancel()
+
+		m.mutex.Lock()
+		m.active = nil
+		if len(m.queue) > 0 {
+			m.active, m.queue = m.queue[0], m.queue[1:]
+		}
+		d = m.active
+		m.mutex.Unlock()
+	}
+}
+
+// Marks the active deployment as past the point of no return, unless it has already been cancelled
+func (m *deploymentManager) commit(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.active != nil && m.active.ctx == ctx {
+		m.active.committed = true
+	}
+	return nil
+}
+
+// Cancels the deployment for requestId, or the active deployment when requestId is empty. Queued deployments
+// are removed from the queue. The active deployment is aborted unless edge has already been stopped, in which
+// case it completes, rolling back if the new edge fails.
+func (m *deploymentManager) cancel(requestId string) (string, *deployment, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, queued := range m.queue {
+		if queued.requestId == requestId {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			queued.cancel()
+			return cancelOutcomeDequeued, queued, nil
+		}
+	}
+
+	if m.active == nil || (requestId != "" && m.active.requestId != requestId) {
+		if requestId == "" {
+			return "", nil, errors.New("No request is in progress")
+		}
+		return "", nil, errors.New("Request " + requestId + " is not in progress or queued")
+	}
+
+	if m.active.committed {
+		return cancelOutcomeCompleting, m.active, nil
+	}
+	m.active.cancel()
+	return cancelOutcomeAborted, m.active, nil
+}
+
+// Called by actions before stopping edge. Returns an error if the deployment was cancelled.
+func commitDeployment(ctx context.Context) error {
+	if err := deployments.commit(ctx); err != nil {
+		log.Println("[INFO] commitDeployment - Request cancelled before edge was stopped")
+		return err
+	}
+	return nil
+}
+
+// Handles a cancel request. The request to cancel is identified by the optional targetRequestId
+// attribute, the request in progress is cancelled when it is omitted.
+func cancelRequest(ctx context.Context, jsonPayload map[string]interface{}) {
+	targetRequestId, _ := jsonPayload["targetRequestId"].(string)
+
+	outcome, target, err := deployments.cancel(targetRequestId)
+	if err != nil {
+		log.Printf("[ERROR] cancelRequest - %s\n", err.Error())
+		addErrorCodeToPayload(jsonPayload, errorCodeNotFound, err.Error())
+		return
+	}
+
+	jsonPayload["targetRequestId"] = target.requestId
+	jsonPayload["outcome"] = outcome
+
+	switch outcome {
+	case cancelOutcomeDequeued:
+		log.Printf("[INFO] cancelRequest - Removed queued request %s\n", target.requestId)
+		jsonPayload["cancelled"] = true
+		jsonPayload["message"] = "Request " + target.requestId + " was removed from the queue"
+
+		target.jsonPayload["cancelled"] = true
+		addErrorToPayload(target.jsonPayload, "Request cancelled before it started, edge was not modified")
+		publishResult(target.jsonPayload)
+	case cancelOutcomeAborted:
+		log.Printf("[INFO] cancelRequest - Aborting request %s\n", target.requestId)
+		jsonPayload["cancelled"] = true
+		jsonPayload["message"] = "Request " + target.requestId + " is being aborted, edge was not modified"
+	case cancelOutcomeCompleting:
+		log.Printf("[INFO] cancelRequest - Request %s is past the point of no return\n", target.requestId)
+		jsonPayload["cancelled"] = false
+		jsonPayload["message"] = "Edge has already been stopped for request " + target.requestId + ", it will complete, rolling back if the new edge fails"
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The container engine operations needed to upgrade a containerized edge. Implemented by dockerClient
+// against the Docker Engine API, and can be replaced by a fake.
+type containerRuntime interface {
+	InspectContainer(ctx context.Context, name string) (*containerInfo, error)
+	InspectImage(ctx context.Context, image string) (*imageInfo, error)
+	PullImage(ctx context.Context, image string) error
+	LoadImage(ctx context.Context, archive string) error
+	CreateContainer(ctx context.Context, name string, config map[string]interface{}) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	StopContainer(ctx context.Context, id string, timeout time.Duration) error
+	RenameContainer(ctx context.Context, id string, name string) error
+	RemoveContainer(ctx context.Context, id string) error
+}
+
+// The parts of a container inspect response needed to recreate the container. The configuration is
+// kept as generic maps so that settings unknown to the adapter are carried over unchanged.
+type containerInfo struct {
+	Id              string                 `json:"Id"`
+	Name            string                 `json:"Name"`
+	Image           string                 `json:"Image"`
+	Path            string                 `json:"Path"`
+	Args            []string               `json:"Args"`
+	Config          map[string]interface{} `json:"Config"`
+	HostConfig      map[string]interface{} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]map[string]interface{} `json:"Networks"`
+	} `json:"NetworkSettings"`
+	State struct {
+		Status  string `json:"Status"`
+		Running bool   `json:"Running"`
+		Pid     int    `json:"Pid"`
+	} `json:"State"`
+}
+
+type imageInfo struct {
+	Id       string                 `json:"Id"`
+	RepoTags []string               `json:"RepoTags"`
+	Config   map[string]interface{} `json:"Config"`
+}
+
+// An error response from the Docker Engine API
+type dockerError struct {
+	statusCode int
+	message    string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("Docker API error %d: %s", e.statusCode, e.message)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *dockerError
+	return errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound
+}
+
+// Talks to the Docker Engine API over its unix socket
+type dockerClient struct {
+	client *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	return &dockerClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Sends a request to the Docker Engine API. Responses with an error status are returned as a dockerError.
+func (c *dockerClient) do(ctx context.Context, method string, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	//The host is ignored, requests are always sent over the socket
+	reqURL := "http://docker" + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	log.Printf("[DEBUG] dockerClient.do - %s %s\n", method, reqURL)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.New("Error connecting to the docker daemon: " + err.Error())
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		contents, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(contents, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = string(contents)
+		}
+		return nil, &dockerError{statusCode: resp.StatusCode, message: apiErr.Message}
+	}
+	return resp, nil
+}
+
+// Sends a request and decodes the JSON response into result, when not nil
+func (c *dockerClient) doJSON(ctx context.Context, method string, path string, query url.Values, body interface{}, result interface{}) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		contents, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(contents)
+		contentType = "application/json"
+	}
+
+	resp, err := c.do(ctx, method, path, query, reader, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *dockerClient) InspectContainer(ctx context.Context, name string) (*containerInfo, error) {
+	var info containerInfo
+	if err := c.doJSON(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *dockerClient) InspectImage(ctx context.Context, image string) (*imageInfo, error) {
+	var info imageInfo
+	if err := c.doJSON(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *dockerClient) PullImage(ctx context.Context, image string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {image}}, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readProgressStream(resp.Body)
+}
+
+func (c *dockerClient) LoadImage(ctx context.Context, archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	resp, err := c.do(ctx, http.MethodPost, "/images/load", url.Values{"quiet": {"1"}}, file, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readProgressStream(resp.Body)
+}
+
+func (c *dockerClient) CreateContainer(ctx context.Context, name string, config map[string]interface{}) (string, error) {
+	var created struct {
+		Id       string   `json:"Id"`
+		Warnings []string `json:"Warnings"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, "/containers/create", url.Values{"name": {name}}, config, &created); err != nil {
+		return "", err
+	}
+	for _, warning := range created.Warnings {
+		log.Printf("[WARN] CreateContainer - %s\n", warning)
+	}
+	return created.Id, nil
+}
+
+func (c *dockerClient) StartContainer(ctx context.Context, id string) error {
+	//304 Not Modified is returned when the container is already running
+	return c.doJSON(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil, nil, nil)
+}
+
+func (c *dockerClient) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{"t": {strconv.Itoa(int(timeout.Seconds()))}}
+	return c.doJSON(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop", query, nil, nil)
+}
+
+func (c *dockerClient) RenameContainer(ctx context.Context, id string, name string) error {
+	return c.doJSON(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/rename", url.Values{"name": {name}}, nil, nil)
+}
+
+func (c *dockerClient) RemoveContainer(ctx context.Context, id string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/containers/"+url.PathEscape(id), url.Values{"force": {"1"}}, nil, nil)
+}
+
+// Reads the JSON messages streamed while an image is pulled or loaded, returning the first error reported
+func readProgressStream(body io.Reader) error {
+	decoder := json.NewDecoder(body)
+	for {
+		var message struct {
+			Status string `json:"status"`
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("Error reading docker response: " + err.Error())
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+		if message.Status != "" || message.Stream != "" {
+			log.Printf("[DEBUG] readProgressStream - %s%s\n", message.Status, message.Stream)
+		}
+	}
+}
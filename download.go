@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const maxDownloadBackoff = 5 * time.Minute
+
+var httpClient *http.Client
+
+// Creates the HTTP client used to download edge. Server certificates are always verified, against the
+// system roots and, when specified, the CA bundle. A client certificate is presented when configured.
+func initHTTPClient() error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caBundle != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			log.Println("[WARN] initHTTPClient - Unable to load system certificate pool, using CA bundle only")
+			roots = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return errors.New("Error reading CA bundle: " + err.Error())
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in CA bundle " + caBundle)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return errors.New("Both clientCert and clientKey must be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return errors.New("Error loading client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	//No overall timeout, large archives can take a long time to download over slow links
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+	}
+	return nil
+}
+
+// Returns the location the edge archive is downloaded to
+func archivePath() string {
+	return filepath.Join(stagingDir, edgeDownloadName)
+}
+
+// A location edge release artifacts (the archive, checksum manifest and signature) can be fetched from
+type artifactSource interface {
+	fetch(ctx context.Context, fileName string, destPath string) error
+	String() string
+}
+
+// Fetches artifacts over HTTP(S) from a URL template. The template may contain the {version}, {arch} and
+// {file} placeholders. A template without {file} is the URL of the archive itself, other artifacts are then
+// fetched from the same directory with the same query string, ex. an access token.
+type httpSource struct {
+	template string
+	version  string
+}
+
+func (s httpSource) url(fileName string) (string, error) {
+	expanded := strings.NewReplacer("{version}", s.version, "{arch}", architecture, "{file}", fileName).Replace(s.template)
+	if strings.Contains(s.template, "{file}") || fileName == edgeDownloadName {
+		return expanded, nil
+	}
+
+	archiveURL, err := url.Parse(expanded)
+	if err != nil {
+		return "", errors.New("Invalid download URL " + expanded + ": " + err.Error())
+	}
+	artifactURL := archiveURL.ResolveReference(&url.URL{Path: fileName})
+	artifactURL.RawQuery = archiveURL.RawQuery
+	return artifactURL.String(), nil
+}
+
+func (s httpSource) fetch(ctx context.Context, fileName string, destPath string) error {
+	url, err := s.url(fileName)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] httpSource.fetch - Downloading %s to %s\n", url, destPath)
+	return downloadFile(ctx, url, destPath)
+}
+
+func (s httpSource) String() string {
+	url, err := s.url(edgeDownloadName)
+	if err != nil {
+		return s.template
+	}
+	return url
+}
+
+// Returns the sources to download edge from, in the order they should be tried. The source attribute
+// of the request payload selects a ClearBlade platform bucket set or code service. Otherwise the downloadURL
+// attribute, a single URL template or an array of them, overrides the templates specified by the
+// downloadURLTemplate flag.
+func getArtifactSources(version string, jsonPayload map[string]interface{}) ([]artifactSource, error) {
+	var templates []string
+
+	if jsonPayload["source"] != nil {
+		platformSource, ok := jsonPayload["source"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("The source attribute must be an object")
+		}
+		source, err := getPlatformSource(version, platformSource)
+		if err != nil {
+			return nil, err
+		}
+		return []artifactSource{source}, nil
+	}
+
+	switch override := jsonPayload["downloadURL"].(type) {
+	case nil:
+		templates = strings.Split(downloadURLTemplates, ",")
+	case string:
+		templates = []string{override}
+	case []interface{}:
+		for _, template := range override {
+			templateStr, ok := template.(string)
+			if !ok {
+				return nil, errors.New("The downloadURL attribute must be a string or an array of strings")
+			}
+			templates = append(templates, templateStr)
+		}
+	default:
+		return nil, errors.New("The downloadURL attribute must be a string or an array of strings")
+	}
+
+	sources := []artifactSource{}
+	for _, template := range templates {
+		if template = strings.TrimSpace(template); template != "" {
+			sources = append(sources, httpSource{template: template, version: version})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("No download URL specified")
+	}
+	return sources, nil
+}
+
+// Downloads the edge archive from the first source that provides it and returns that source
+func downloadEdge(ctx context.Context, version string, sources []artifactSource) (artifactSource, error) {
+	setDeployPhase(phaseDownloading)
+	addLogEntry(fmt.Sprintf("Downloading ClearBlade Edge version %s\n", version))
+
+	source, err := downloadArtifact(ctx, sources, edgeDownloadName, archivePath())
+	if err != nil {
+		return nil, errors.New("Error downloading edge binary: " + err.Error())
+	}
+	addLogEntry(fmt.Sprintf("ClearBlade Edge version %s downloaded from %s\n", version, source))
+	return source, nil
+}
+
+// Downloads fileName to destPath from the first source that provides it and returns that source
+func downloadArtifact(ctx context.Context, sources []artifactSource, fileName string, destPath string) (artifactSource, error) {
+	var errs []string
+	for _, source := range sources {
+		log.Printf("[DEBUG] downloadArtifact - Downloading %s from %s to %s\n", fileName, source, destPath)
+		err := source.fetch(ctx, fileName, destPath)
+		if err == nil {
+			return source, nil
+		}
+
+		log.Printf("[ERROR] downloadArtifact - ERROR downloading %s from %s: %s\n", fileName, source, err.Error())
+		if len(sources) > 1 {
+			addLogEntry(fmt.Sprintf("Unable to download %s from %s, trying the next mirror\n", fileName, source))
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// Downloads url to destPath, replacing any existing file. Transient failures are retried with exponential
+// backoff, resuming from the data already received. The partial download is kept when all retries fail, so
+// the next attempt resumes it, and is deleted if the download is cancelled.
+func downloadFile(ctx context.Context, url string, destPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return errors.New("Error creating staging directory: " + err.Error())
+	}
+	removeFile(destPath)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var transient bool
+		if transient, err = downloadAttempt(ctx, url, destPath); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			removeDownload(destPath)
+			return ctx.Err()
+		}
+		if !transient || attempt >= downloadRetries {
+			break
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("[ERROR] downloadFile - ERROR downloading %s, retrying in %s: %s\n", url, delay, err.Error())
+		addLogEvent(logLevelWarn, fmt.Sprintf("Download of %s failed, retrying in %s (retry %d of %d): %s", filepath.Base(destPath), delay.Round(time.Second), attempt+1, downloadRetries, err.Error()))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			removeDownload(destPath)
+			return ctx.Err()
+		}
+	}
+
+	return errors.New("Error downloading " + url + ": " + err.Error())
+}
+
+// Information about a partial download, used to verify the partial file belongs to the same
+// version of the same file before resuming it
+type partialDownload struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	TotalBytes   int64  `json:"totalBytes"`
+}
+
+func partialPath(destPath string) string {
+	return destPath + ".partial"
+}
+
+func partialInfoPath(destPath string) string {
+	return destPath + ".partial.json"
+}
+
+// Removes a download along with any partial download of it
+func removeDownload(destPath string) {
+	removeFile(destPath)
+	removeFile(partialPath(destPath))
+	removeFile(partialInfoPath(destPath))
+}
+
+// Returns the number of bytes of a valid partial download of url, and the validator the server must
+// match for it to be resumed. Invalid partial downloads are deleted.
+func getResumableDownload(url string, destPath string) (int64, string) {
+	info, err := os.Stat(partialPath(destPath))
+	if err != nil {
+		return 0, ""
+	}
+
+	var partial partialDownload
+	contents, err := os.ReadFile(partialInfoPath(destPath))
+	if err == nil {
+		err = json.Unmarshal(contents, &partial)
+	}
+
+	validator := partial.ETag
+	if validator == "" {
+		validator = partial.LastModified
+	}
+
+	switch {
+	case err != nil:
+		log.Printf("[DEBUG] getResumableDownload - Discarding partial download of %s, no download information\n", url)
+	case partial.URL != url:
+		log.Printf("[DEBUG] getResumableDownload - Discarding partial download of %s, it was downloaded from %s\n", url, partial.URL)
+	case validator == "" || partial.TotalBytes <= 0:
+		log.Printf("[DEBUG] getResumableDownload - Discarding partial download of %s, the server does not support resuming it\n", url)
+	case info.Size() == 0 || info.Size() >= partial.TotalBytes:
+		log.Printf("[DEBUG] getResumableDownload - Discarding partial download of %s, unexpected size %d of %d\n", url, info.Size(), partial.TotalBytes)
+	default:
+		return info.Size(), validator
+	}
+
+	removeDownload(destPath)
+	return 0, ""
+}
+
+// Makes a single attempt to download url, resuming a partial download when possible. Returns whether
+// a failure is transient and worth retrying.
+func downloadAttempt(ctx context.Context, url string, destPath string) (bool, error) {
+	offset, validator := getResumableDownload(url, destPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := resp.ContentLength
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			removeDownload(destPath)
+			return true, errors.New("unexpected Content-Range " + resp.Header.Get("Content-Range"))
+		}
+		log.Printf("[DEBUG] downloadAttempt - Resuming download of %s at byte %d\n", url, offset)
+		addLogEntry(fmt.Sprintf("Resuming download of %s at %s\n", filepath.Base(destPath), formatBytes(offset)))
+		flags |= os.O_APPEND
+		if total >= 0 {
+			total += offset
+		}
+	case resp.StatusCode == http.StatusOK:
+		//The file changed, or the server ignored the range, start over
+		offset = 0
+		flags |= os.O_TRUNC
+		if err := writePartialInfo(destPath, partialDownload{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			TotalBytes:   total,
+		}); err != nil {
+			return false, err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		removeDownload(destPath)
+		return true, errors.New("unexpected HTTP status " + resp.Status + " resuming download")
+	default:
+		transient := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return transient, errors.New("unexpected HTTP status " + resp.Status)
+	}
+
+	file, err := os.OpenFile(partialPath(destPath), flags, 0644)
+	if err != nil {
+		return false, errors.New("Error creating " + partialPath(destPath) + ": " + err.Error())
+	}
+
+	progress := newProgressReporter(filepath.Base(destPath), offset, total)
+	written, err := io.Copy(io.MultiWriter(file, progress), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return true, err
+	}
+	if total >= 0 && offset+written != total {
+		return true, fmt.Errorf("received %d of %d bytes", offset+written, total)
+	}
+
+	if err := os.Rename(partialPath(destPath), destPath); err != nil {
+		return false, err
+	}
+	removeFile(partialInfoPath(destPath))
+
+	progress.finish()
+	log.Printf("[DEBUG] downloadAttempt - Downloaded %d bytes from %s to %s\n", offset+written, url, destPath)
+	return false, nil
+}
+
+func writePartialInfo(destPath string, partial partialDownload) error {
+	contents, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partialInfoPath(destPath), contents, 0644)
+}
+
+// Returns the delay before the next retry: exponential backoff from downloadBackoff seconds, capped at
+// maxDownloadBackoff, with jitter so gateways retrying against the same server spread out
+func retryDelay(attempt int) time.Duration {
+	backoff := time.Duration(downloadBackoff) * time.Second
+	for i := 0; i < attempt && backoff < maxDownloadBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDownloadBackoff {
+		backoff = maxDownloadBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const stagingDirPrefix = "edge-staging-"
+
+// Opens a tar.gz archive, returning a tar reader along with a function closing the archive
+func openArchive(archive string) (*tar.Reader, *gzip.Reader, func(), error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, nil, errors.New("Error opening " + archive + ": " + err.Error())
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, errors.New("Archive " + archive + " is not a valid gzip file: " + err.Error())
+	}
+
+	return tar.NewReader(gzipReader), gzipReader, func() {
+		gzipReader.Close()
+		file.Close()
+	}, nil
+}
+
+// Reads the entire archive, verifying its gzip checksum and tar structure, and returns the
+// total size of the regular files it contains
+func archiveSize(archive string) (int64, error) {
+	tarReader, gzipReader, closeArchive, err := openArchive(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer closeArchive()
+
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.New("Archive " + archive + " is corrupt: " + err.Error())
+		}
+		if header.Typeflag == tar.TypeReg {
+			size += header.Size
+		}
+	}
+
+	//Drain the gzip stream so its checksum is verified
+	if _, err = io.Copy(io.Discard, gzipReader); err != nil {
+		return 0, errors.New("Archive " + archive + " is corrupt: " + err.Error())
+	}
+	return size, nil
+}
+
+// Extracts the archive into destDir. Entries that would be written outside of destDir and
+// link entries are rejected, device files and other special entries are skipped.
+func extractArchive(archive string, destDir string) error {
+	tarReader, _, closeArchive, err := openArchive(archive)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("Archive " + archive + " is corrupt: " + err.Error())
+		}
+
+		target, err := archiveEntryPath(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return errors.New("Error creating " + target + ": " + err.Error())
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.New("Error creating " + filepath.Dir(target) + ": " + err.Error())
+			}
+			if err = extractArchiveFile(tarReader, target, os.FileMode(header.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("Archive entry %s is a link, links are not allowed in edge archives", header.Name)
+		default:
+			log.Printf("[WARN] extractArchive - Skipping archive entry %s of type %c\n", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// Returns the path an archive entry is extracted to, rejecting entries that resolve outside of destDir
+func archiveEntryPath(destDir string, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", errors.New("Archive entry " + name + " has an absolute path")
+	}
+	target := filepath.Join(destDir, name)
+	if target != destDir && !strings.HasPrefix(target, destDir+string(os.PathSeparator)) {
+		return "", errors.New("Archive entry " + name + " is outside of the extraction directory")
+	}
+	return target, nil
+}
+
+func extractArchiveFile(reader io.Reader, target string, mode os.FileMode) error {
+	//O_EXCL ensures an earlier entry cannot be replaced through the same name
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return errors.New("Error creating " + target + ": " + err.Error())
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, reader); err != nil {
+		return errors.New("Error extracting " + target + ": " + err.Error())
+	}
+	return file.Close()
+}
+
+// Returns the edge binary extracted into dir. Release archives contain edge-<version>, but other
+// archives are accepted when the binary can be identified unambiguously: a file named edge or
+// edge-*, or the only file in the archive.
+func findEdgeBinary(dir string, version string) (string, error) {
+	var files, edgeFiles []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+			if info.Name() == "edge" || strings.HasPrefix(info.Name(), "edge-") {
+				edgeFiles = append(edgeFiles, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.New("Error searching for the edge binary: " + err.Error())
+	}
+
+	for _, file := range edgeFiles {
+		if filepath.Base(file) == "edge-"+version {
+			return file, nil
+		}
+	}
+	if len(edgeFiles) == 1 {
+		return edgeFiles[0], nil
+	}
+	if len(edgeFiles) == 0 && len(files) == 1 {
+		return files[0], nil
+	}
+	if len(files) == 0 {
+		return "", errors.New("Archive " + edgeDownloadName + " is empty")
+	}
+	return "", fmt.Errorf("Unable to identify the edge binary in %s, it contains %d files", edgeDownloadName, len(files))
+}
+
+// Creates the directory a deployment's archive is extracted into
+func createStagingDir() (string, error) {
+	dir, err := os.MkdirTemp(stagingDir, stagingDirPrefix)
+	if err != nil {
+		return "", errors.New("Error creating staging directory in " + stagingDir + ": " + err.Error())
+	}
+	return dir, nil
+}
+
+func removeStagingDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("[ERROR] removeStagingDir - ERROR removing %s: %s\n", dir, err.Error())
+	}
+}
+
+// Removes staging directories left behind when the adapter exited during a deployment
+func removeStaleStagingDirs() {
+	dirs, err := filepath.Glob(filepath.Join(stagingDir, stagingDirPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		log.Printf("[INFO] removeStaleStagingDirs - Removing stale staging directory %s\n", dir)
+		removeStagingDir(dir)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An archive entry and, for regular files, its contents
+type testArchiveEntry struct {
+	header   tar.Header
+	contents string
+}
+
+func writeTestArchive(t *testing.T, entries []testArchiveEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "edge.tar.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.contents))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err = tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tarWriter.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	destDir := filepath.Join(os.TempDir(), "edge-staging-test")
+	tests := []struct {
+		name     string
+		expected string
+		error    string
+	}{
+		{"edge-4.1", filepath.Join(destDir, "edge-4.1"), ""},
+		{"a/./b", filepath.Join(destDir, "a", "b"), ""},
+		{"a/../b", filepath.Join(destDir, "b"), ""},
+		{"./", destDir, ""},
+		{"../x", "", "outside of the extraction directory"},
+		{"a/../../x", "", "outside of the extraction directory"},
+		{"..", "", "outside of the extraction directory"},
+		{"/abs", "", "absolute path"},
+		{"/usr/bin/clearblade/edge", "", "absolute path"},
+	}
+
+	for _, test := range tests {
+		target, err := archiveEntryPath(destDir, test.name)
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("archiveEntryPath(%q) = %q, %v, expected error %q", test.name, target, err, test.error)
+			}
+			continue
+		}
+		if err != nil || target != test.expected {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, expected %q", test.name, target, err, test.expected)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testArchiveEntry
+		error   string
+	}{
+		{
+			name: "files and directories",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "edge/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{header: tar.Header{Name: "edge/edge-4.1", Typeflag: tar.TypeReg, Mode: 0755}, contents: "binary"},
+			},
+		},
+		{
+			name: "symlink",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "edge-4.1", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/clearblade/edge"}},
+			},
+			error: "links are not allowed",
+		},
+		{
+			name: "hard link",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "edge-4.1", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}},
+			},
+			error: "links are not allowed",
+		},
+		{
+			name: "path traversal",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "../edge-4.1", Typeflag: tar.TypeReg}, contents: "binary"},
+			},
+			error: "outside of the extraction directory",
+		},
+		{
+			name: "duplicate entry",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "edge-4.1", Typeflag: tar.TypeReg}, contents: "binary"},
+				{header: tar.Header{Name: "edge-4.1", Typeflag: tar.TypeReg}, contents: "replaced"},
+			},
+			error: "Error creating",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := writeTestArchive(t, test.entries)
+			parent := t.TempDir()
+			destDir := filepath.Join(parent, "staging")
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := extractArchive(archive, destDir)
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("extraction failed: %s", err.Error())
+				}
+				contents, err := os.ReadFile(filepath.Join(destDir, "edge", "edge-4.1"))
+				if err != nil || string(contents) != "binary" {
+					t.Errorf("extracted %q (%v), expected %q", contents, err, "binary")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, expected %q", err, test.error)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "edge-4.1")); !os.IsNotExist(err) {
+				t.Error("an entry was written outside of the extraction directory")
+			}
+			if target, err := os.Lstat(filepath.Join(destDir, "edge-4.1")); err == nil && target.Mode()&os.ModeSymlink != 0 {
+				t.Error("a link entry was extracted")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var edgeIdArgRegex = regexp.MustCompile(`-edge-id=([^ ]+)`)
+
+// A running edge process
+type edgeProcess struct {
+	pid    int
+	edgeId string
+}
+
+// Returns the running edge processes
+func getEdgeProcesses() ([]edgeProcess, error) {
+	//Edge in a container is the main process of the container
+	if manager, ok := serviceManager.(*dockerManager); ok {
+		return manager.edgeProcesses()
+	}
+
+	psOutput, err := executeOSCommand("ps", []string{"-C", "edge", "-o", "pid=,args="})
+	if err != nil {
+		//ps exits with an error when no processes match
+		return []edgeProcess{}, nil
+	}
+
+	processes := []edgeProcess{}
+	for _, line := range strings.Split(psOutput.(string), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		process := edgeProcess{pid: pid}
+		if match := edgeIdArgRegex.FindStringSubmatch(line); match != nil {
+			process.edgeId = match[1]
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// Verifies the restarted edge stays up for healthCheckDuration seconds with the expected edge ID
+// and, when configured, that healthCheckURL responds successfully
+func checkEdgeHealth() error {
+	duration := time.Duration(healthCheckDuration) * time.Second
+	interval := time.Duration(healthCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	addLogEntry(fmt.Sprintf("Verifying edge health for %s\n", duration))
+
+	var pid int
+	urlHealthy := healthCheckURL == ""
+	deadline := time.Now().Add(duration)
+
+	for {
+		processes, err := getEdgeProcesses()
+		if err != nil {
+			return err
+		}
+
+		var process *edgeProcess
+		for i := range processes {
+			if processes[i].edgeId == edgeId {
+				process = &processes[i]
+				break
+			}
+		}
+
+		if process == nil {
+			//Give edge until the end of the health check to start, it must stay running once it has
+			if pid == 0 && len(processes) == 0 && time.Now().Before(deadline) {
+				log.Println("[DEBUG] checkEdgeHealth - Waiting for edge to start")
+				time.Sleep(interval)
+				continue
+			}
+			if len(processes) > 0 {
+				log.Printf("[ERROR] checkEdgeHealth - Edge running with unexpected edge ID %s\n", processes[0].edgeId)
+				return fmt.Errorf("Edge is running with edge ID %s, expected %s", processes[0].edgeId, edgeId)
+			}
+			log.Println("[ERROR] checkEdgeHealth - Edge is not running")
+			return errors.New("Edge is not running")
+		}
+
+		//A changed PID means edge exited and was restarted by the init system
+		if pid != 0 && process.pid != pid {
+			log.Printf("[ERROR] checkEdgeHealth - Edge restarted, pid changed from %d to %d\n", pid, process.pid)
+			return fmt.Errorf("Edge exited and was restarted (pid %d, previously %d)", process.pid, pid)
+		}
+		pid = process.pid
+
+		if !urlHealthy {
+			if err := checkHealthURL(); err != nil {
+				log.Printf("[DEBUG] checkEdgeHealth - Health URL not yet healthy: %s\n", err.Error())
+			} else {
+				addLogEntry(fmt.Sprintf("Edge health check %s succeeded\n", healthCheckURL))
+				urlHealthy = true
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+
+	if !urlHealthy {
+		return errors.New("Edge health check " + healthCheckURL + " did not succeed within " + duration.String())
+	}
+
+	addLogEntry(fmt.Sprintf("Edge is healthy, running with pid %d\n", pid))
+	return nil
+}
+
+func checkHealthURL() error {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: httpClient.Transport}
+	resp, err := client.Get(healthCheckURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected HTTP status " + resp.Status)
+	}
+	return nil
+}
+
+// Polls until no edge process is running, failing after stopTimeout seconds
+func waitForEdgeStop() error {
+	timeout := time.Duration(stopTimeout) * time.Second
+	start := time.Now()
+	logged := false
+
+	for {
+		processes, err := getEdgeProcesses()
+		if err != nil {
+			return err
+		}
+		if len(processes) == 0 {
+			if logged {
+				addLogEntry(fmt.Sprintf("Edge exited after %s\n", time.Since(start).Round(time.Second/10)))
+			}
+			return nil
+		}
+
+		if !logged {
+			addLogEntry(fmt.Sprintf("Waiting up to %s for edge process %s to exit\n", timeout, formatPids(processes)))
+			logged = true
+		}
+		if time.Since(start) >= timeout {
+			return fmt.Errorf("Edge process %s still running %s after edge was stopped", formatPids(processes), timeout)
+		}
+		time.Sleep(processPollInterval)
+	}
+}
+
+// Polls until an edge process other than the previous processes is running, failing after startTimeout seconds
+func waitForEdgeStart(previous []edgeProcess) error {
+	timeout := time.Duration(startTimeout) * time.Second
+	start := time.Now()
+	addLogEntry(fmt.Sprintf("Waiting up to %s for edge to start\n", timeout))
+
+	for {
+		processes, err := getEdgeProcesses()
+		if err != nil {
+			return err
+		}
+		for _, process := range processes {
+			if !containsPid(previous, process.pid) {
+				if len(previous) > 0 {
+					addLogEntry(fmt.Sprintf("Edge started with process ID %d after %s, replacing process %s\n", process.pid, time.Since(start).Round(time.Second/10), formatPids(previous)))
+				} else {
+					addLogEntry(fmt.Sprintf("Edge started with process ID %d after %s\n", process.pid, time.Since(start).Round(time.Second/10)))
+				}
+				return nil
+			}
+		}
+
+		if time.Since(start) >= timeout {
+			if len(processes) > 0 {
+				return fmt.Errorf("Edge process ID did not change within %s, process %s is still running", timeout, formatPids(processes))
+			}
+			return fmt.Errorf("Edge did not start within %s", timeout)
+		}
+		time.Sleep(processPollInterval)
+	}
+}
+
+func containsPid(processes []edgeProcess, pid int) bool {
+	for _, process := range processes {
+		if process.pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func formatPids(processes []edgeProcess) string {
+	pids := make([]string, 0, len(processes))
+	for _, process := range processes {
+		pids = append(pids, strconv.Itoa(process.pid))
+	}
+	return strings.Join(pids, ", ")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const replaceTempSuffix = ".new-"
+
+// Replaces dest with a copy of src owned by uid:gid with the given mode. The copy is written to a
+// temporary file in the same directory, synced to disk and then renamed over dest, so that a crash
+// at any point leaves either the old or the new file at dest.
+func replaceFile(src string, dest string, uid int, gid int, mode os.FileMode) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return errors.New("Error opening " + src + ": " + err.Error())
+	}
+	defer source.Close()
+
+	dir := filepath.Dir(dest)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(dest)+replaceTempSuffix)
+	if err != nil {
+		return errors.New("Error creating temporary file in " + dir + ": " + err.Error())
+	}
+	tempPath := temp.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			temp.Close()
+			removeFile(tempPath)
+		}
+	}()
+
+	if _, err = io.Copy(temp, source); err != nil {
+		return errors.New("Error copying " + src + " to " + tempPath + ": " + err.Error())
+	}
+	//Change the owner first, changing it clears the setuid and setgid bits
+	if err = temp.Chown(uid, gid); err != nil {
+		return errors.New("Error changing the owner of " + tempPath + ": " + err.Error())
+	}
+	if err = temp.Chmod(mode); err != nil {
+		return errors.New("Error changing the mode of " + tempPath + ": " + err.Error())
+	}
+	if err = temp.Sync(); err != nil {
+		return errors.New("Error syncing " + tempPath + ": " + err.Error())
+	}
+	if err = temp.Close(); err != nil {
+		return errors.New("Error closing " + tempPath + ": " + err.Error())
+	}
+
+	if err = os.Rename(tempPath, dest); err != nil {
+		return errors.New("Error renaming " + tempPath + " to " + dest + ": " + err.Error())
+	}
+	renamed = true
+
+	//Persist the rename itself
+	if err = syncDir(dir); err != nil {
+		log.Printf("[WARN] replaceFile - Unable to sync %s: %s\n", dir, err.Error())
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Returns the owner, group and permissions of a file
+func fileOwnership(path string) (int, int, os.FileMode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, errors.New("Unable to determine the owner of " + path)
+	}
+	return int(stat.Uid), int(stat.Gid), info.Mode().Perm(), nil
+}
+
+// Removes temporary files left in the install directory when the adapter exited while replacing edge
+func removeStaleInstallFiles() {
+	files, err := filepath.Glob(filepath.Join(edgeInstallDir, "."+filepath.Base(edgeBinaryPath())+replaceTempSuffix+"*"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		log.Printf("[INFO] removeStaleInstallFiles - Removing stale temporary file %s\n", file)
+		removeFile(file)
+	}
+}
+
+// Copies src to dest, preserving its owner, permissions and modification time like cp -p
+func copyFile(src string, dest string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	//Copy to a temporary file renamed into place, so that an incomplete copy is never left under the destination
+	//name. The leading dot keeps it from being listed as a backup.
+	tmpPath := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	target, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	defer removeFile(tmpPath)
+
+	if _, err = io.Copy(target, source); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err = target.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+			log.Printf("[WARN] copyFile - Unable to preserve the owner of %s: %s\n", src, err.Error())
+		}
+	}
+	//Chmod after Chown, which clears the setuid and setgid bits, and in case the umask masked the mode
+	if err = target.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = target.Sync(); err != nil {
+		return err
+	}
+	if err = target.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+// Resolves the edgeOwner, edgeGroup and edgeMode flags to the owner, group and permissions of the installed edge binary
+func lookupEdgeOwnership() (int, int, os.FileMode, error) {
+	uid, err := lookupId(edgeOwner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return 0, 0, 0, errors.New("Unknown edge owner " + edgeOwner + ": " + err.Error())
+	}
+
+	gid, err := lookupId(edgeGroup, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return 0, 0, 0, errors.New("Unknown edge group " + edgeGroup + ": " + err.Error())
+	}
+
+	mode, err := parseEdgeMode()
+	if err != nil {
+		return 0, 0, 0, errors.New("Invalid edge mode " + edgeMode + ": " + err.Error())
+	}
+	return uid, gid, mode, nil
+}
+
+// Accepts a numeric ID or a name resolved with lookup
+func lookupId(nameOrId string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrId)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func parseEdgeMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(edgeMode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, errors.New("only permission bits may be specified")
+	}
+	return os.FileMode(mode), nil
+}
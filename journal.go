@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	journalFile = "journal.json"
+)
+
+// Records the progress of a deployment once edge is about to be stopped, so that a deployment
+// interrupted by an adapter crash or a reboot can be finished or rolled back on the next start
+type deploymentJournal struct {
+	RequestId           string                 `json:"requestId"`
+	Request             map[string]interface{} `json:"request"`
+	EdgeId              string                 `json:"edgeId"`
+	TargetVersion       string                 `json:"targetVersion"`
+	BackupPath          string                 `json:"backupPath,omitempty"`
+	BackupVersion       string                 `json:"backupVersion,omitempty"`
+	PreviousContainerId string                 `json:"previousContainerId,omitempty"`
+	PreviousImage       string                 `json:"previousImage,omitempty"`
+	Phase               string                 `json:"phase"`
+	Updated             time.Time              `json:"updated"`
+}
+
+var (
+	activeJournal      *deploymentJournal
+	interruptedJournal *deploymentJournal
+	recoverOnce        sync.Once
+)
+
+func journalPath() string {
+	return filepath.Join(stateDir, journalFile)
+}
+
+// Starts journaling the active deployment. The backup, if any, is restored should the deployment be interrupted.
+func startJournal(jsonPayload map[string]interface{}, targetVersion string, backup *edgeBackup) {
+	request := make(map[string]interface{}, len(jsonPayload))
+	for key, value := range jsonPayload {
+		request[key] = value
+	}
+
+	activeJournal = &deploymentJournal{
+		RequestId:     deployRequestId,
+		Request:       request,
+		EdgeId:        edgeId,
+		TargetVersion: targetVersion,
+	}
+	if backup != nil {
+		activeJournal.BackupPath = backup.path
+		activeJournal.BackupVersion = backup.version
+	}
+	setDeployPhase(phaseStopping)
+}
+
+// Records the container replaced by a container upgrade, so that an interrupted upgrade can put it back
+func setJournalContainer(containerId string, image string, version string) {
+	if activeJournal == nil {
+		return
+	}
+	activeJournal.PreviousContainerId = containerId
+	activeJournal.PreviousImage = image
+	activeJournal.BackupVersion = version
+
+	if err := writeJournal(activeJournal); err != nil {
+		log.Printf("[ERROR] setJournalContainer - ERROR writing deployment journal: %s\n", err.Error())
+	}
+}
+
+// Records the phase the active deployment is entering in the journal
+func setJournalPhase(phase string) {
+	if activeJournal == nil {
+		return
+	}
+	activeJournal.Phase = phase
+	activeJournal.Updated = time.Now()
+
+	if err := writeJournal(activeJournal); err != nil {
+		log.Printf("[ERROR] setJournalPhase - ERROR writing deployment journal: %s\n", err.Error())
+	}
+}
+
+// Removes the journal once the active deployment has completed
+func clearJournal() {
+	activeJournal = nil
+	removeFile(journalPath())
+}
+
+// Writes the journal to a temporary file and renames it, so a crash never leaves a partially written journal
+func writeJournal(journal *deploymentJournal) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := journalPath() + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(contents); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeFile(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, journalPath())
+}
+
+// Reads the journal left behind by a deployment that was interrupted. Returns nil if there is none.
+func readJournal() (*deploymentJournal, error) {
+	contents, err := os.ReadFile(journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var journal deploymentJournal
+	if err := json.Unmarshal(contents, &journal); err != nil {
+		return nil, errors.New("Error parsing deployment journal: " + err.Error())
+	}
+	if journal.Request == nil {
+		journal.Request = map[string]interface{}{"requestId": journal.RequestId}
+	}
+	return &journal, nil
+}
+
+// Loads the journal of an interrupted deployment, if any, at startup
+func loadInterruptedJournal() {
+	journal, err := readJournal()
+	if err != nil {
+		log.Printf("[ERROR] loadInterruptedJournal - ERROR reading deployment journal: %s\n", err.Error())
+		return
+	}
+	if journal != nil {
+		log.Printf("[INFO] loadInterruptedJournal - Request %s was interrupted while %s\n", journal.RequestId, journal.Phase)
+		interruptedJournal = journal
+	}
+}
+
+// Finishes or rolls back the interrupted deployment, publishing the outcome for the original request.
+// Runs through the deployment manager so that no other deployment can run at the same time.
+func recoverInterruptedDeployment() {
+	if interruptedJournal == nil {
+		return
+	}
+	journal := interruptedJournal
+	interruptedJournal = nil
+
+	payload, _ := json.Marshal(journal.Request)
+	journal.Request["recovered"] = true
+	delete(journal.Request, "error")
+	delete(journal.Request, "success")
+
+	deployments.submit(&deployment{
+		requestId:   journal.RequestId,
+		payload:     payload,
+		jsonPayload: journal.Request,
+		action: &requestAction{
+			handle: func(ctx context.Context, jsonPayload map[string]interface{}) {
+				//Edge was already modified by the interrupted deployment, recovery cannot be cancelled
+				if err := commitDeployment(ctx); err != nil {
+					return
+				}
+				finishInterruptedDeployment(journal, jsonPayload)
+			},
+			modifiesEdge: true,
+		},
+	})
+}
+
+func finishInterruptedDeployment(journal *deploymentJournal, jsonPayload map[string]interface{}) {
+	addLogEntry(fmt.Sprintf("Recovering request %s, interrupted while %s\n", journal.RequestId, journal.Phase))
+
+	//Continue journaling under the original request in case recovery is interrupted as well
+	activeJournal = journal
+	defer clearJournal()
+
+	if manager, ok := serviceManager.(*dockerManager); ok && journal.PreviousContainerId != "" {
+		finishInterruptedContainerUpgrade(manager, journal, jsonPayload)
+		return
+	}
+
+	//The new edge binary was installed, it only needs to be started
+	if journal.Phase == phaseStarting || journal.Phase == phaseVerifying {
+		err := startEdgeIfStopped()
+		if err == nil {
+			setDeployPhase(phaseVerifying)
+			err = checkEdgeHealth()
+		}
+		if err == nil {
+			setInstalledVersion(journal.TargetVersion)
+			jsonPayload["runningVersion"] = journal.TargetVersion
+			addLogEntry(fmt.Sprintf("Recovered request %s, edge version %s is running\n", journal.RequestId, journal.TargetVersion))
+			return
+		}
+		addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+	}
+
+	//Edge binary may be missing or incomplete, restore the backup
+	if journal.BackupPath != "" {
+		if _, err := os.Stat(journal.BackupPath); err == nil {
+			backup := &edgeBackup{path: journal.BackupPath, version: journal.BackupVersion}
+			if err = rollbackEdge(backup); err != nil {
+				addErrorToPayload(jsonPayload, "Error encountered rolling back edge: "+err.Error())
+			} else {
+				jsonPayload["rolledBack"] = true
+				jsonPayload["runningVersion"] = backup.version
+			}
+			return
+		}
+		log.Printf("[ERROR] finishInterruptedDeployment - Backup %s no longer exists\n", journal.BackupPath)
+	}
+
+	//Nothing to restore, ex. an interrupted restart
+	err := startEdgeIfStopped()
+	if err == nil {
+		err = checkEdgeHealth()
+	}
+	if err != nil {
+		addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+		return
+	}
+	jsonPayload["runningVersion"] = getInstalledVersion()
+}
+
+func startEdgeIfStopped() error {
+	processes, err := getEdgeProcesses()
+	if err == nil && len(processes) > 0 {
+		addLogEntry(fmt.Sprintf("Edge is already running with pid %d\n", processes[0].pid))
+		return nil
+	}
+	return startEdge()
+}
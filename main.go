@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -27,25 +29,62 @@ const (
 	initSysTypeInitd   = "init"
 	initSysTypeSystemd = "systemd"
 	initSysTypeMonit   = "monit"
-	downloadDir        = "/tmp"
+	defaultDownloadURL = "https://github.com/ClearBlade/Edge/releases/download/{version}/{file}"
+	signatureExtension = ".sig"
+	adapterLogFile     = "/var/log/updateEdgeAdapter"
 )
 
 var (
-	platformURL      string //Defaults to http://localhost:9000
-	messagingURL     string //Defaults to localhost:1883
-	sysKey           string
-	sysSec           string
-	deviceName       string //Defaults to updateEdgeAdapter
-	activeKey        string
-	logLevel         string //Defaults to info
-	edgeInstallDir   string //Defaults to /usr/bin/clearblade
-	serviceName      string
-	architecture     string
-	initSystem       string
-	edgeDownloadName string
-	deployLogs       []string
-	edgeId           string
-
+	platformURL          string //Defaults to http://localhost:9000
+	messagingURL         string //Defaults to localhost:1883
+	sysKey               string
+	sysSec               string
+	deviceName           string //Defaults to updateEdgeAdapter
+	activeKey            string
+	logLevel             string //Defaults to info
+	edgeInstallDir       string //Defaults to /usr/bin/clearblade
+	serviceName          string
+	edgeOwner            string
+	edgeGroup            string
+	edgeMode             string
+	architecture         string
+	initSystem           string
+	initSystemFlag       string
+	serviceManager       ServiceManager
+	containerName        string
+	containerImage       string
+	dockerSocket         string
+	edgeDownloadName     string
+	deployRequestId      string
+	edgeId               string
+	checksumManifest     string
+	requireChecksum      bool
+	trustedKeysFlag      string
+	trustedKeysFile      string
+	trustedKeys          []ed25519.PublicKey
+	stagingDir           string //Defaults to /tmp
+	downloadURLTemplates string
+	caBundle             string
+	clientCert           string
+	clientKey            string
+	freeSpaceMargin      int
+	downloadRetries      int
+	downloadBackoff      int
+	progressInterval     int
+	progressPercentStep  float64
+	publishLogHistory    bool
+	stateDir             string
+	concurrencyPolicy    string
+	maxQueuedRequests    int
+	backupDir            string //Defaults to <edgeInstallDir>/backups
+	maxBackups           int
+	healthCheckDuration  int
+	healthCheckInterval  int
+	healthCheckURL       string
+	stopTimeout          int
+	startTimeout         int
+
+	adapterVersion            = "dev" //Set at build time with -ldflags "-X main.adapterVersion=<version>"
 	topicRoot                 = "edge/update"
 	cbBroker                  cbPlatformBroker
 	cbSubscribeChannel        <-chan *mqttTypes.Publish
@@ -75,7 +114,39 @@ func init() {
 	flag.StringVar(&messagingURL, "messagingURL", "", "messaging URL (required")
 	flag.StringVar(&logLevel, "logLevel", "info", "The level of logging to use. Available levels are 'debug, 'info', 'warn', 'error', 'fatal' (optional)")
 	flag.StringVar(&edgeInstallDir, "edgeInstallDir", "/usr/bin/clearblade", "edge installation directory (required)")
+	flag.StringVar(&initSystemFlag, "initSystem", "", "init system managing edge, one of "+strings.Join(getServiceManagerNames(), ", ")+". Detected when not specified (optional)")
+	flag.StringVar(&containerName, "containerName", "edge", "name of the docker container edge runs in, when the init system is docker (optional)")
+	flag.StringVar(&containerImage, "containerImage", "", "image repository containerized edge is upgraded from, defaults to the repository of the running image (optional)")
+	flag.StringVar(&dockerSocket, "dockerSocket", "/var/run/docker.sock", "unix socket of the docker daemon (optional)")
 	flag.StringVar(&serviceName, "serviceName", "edge", "the name of the init.d or system.d service name Edge is running under (optional)")
+	flag.StringVar(&edgeOwner, "edgeOwner", "root", "user name or ID the installed edge binary is owned by (optional)")
+	flag.StringVar(&edgeGroup, "edgeGroup", "root", "group name or ID the installed edge binary is owned by (optional)")
+	flag.StringVar(&edgeMode, "edgeMode", "0755", "octal permissions of the installed edge binary (optional)")
+	flag.StringVar(&checksumManifest, "checksumManifest", "SHA256SUMS", "name of the sha256 checksum manifest published alongside the edge release (optional)")
+	flag.BoolVar(&requireChecksum, "requireChecksum", false, "abort the upgrade when no sha256 checksum is available for the edge archive (optional)")
+	flag.StringVar(&trustedKeysFlag, "trustedKeys", "", "comma separated list of base64 encoded ed25519 public keys trusted to sign edge archives (optional)")
+	flag.StringVar(&downloadURLTemplates, "downloadURLTemplate", defaultDownloadURL, "comma separated list of URL templates edge is downloaded from, tried in order. Supports the {version}, {arch} and {file} placeholders (optional)")
+	flag.StringVar(&backupDir, "backupDir", "", "directory previous edge binaries are backed up to, defaults to <edgeInstallDir>/backups (optional)")
+	flag.IntVar(&maxBackups, "maxBackups", 3, "number of previous edge binaries to keep (optional)")
+	flag.IntVar(&stopTimeout, "stopTimeout", 60, "number of seconds to wait for edge to exit once it has been stopped (optional)")
+	flag.IntVar(&startTimeout, "startTimeout", 60, "number of seconds to wait for a new edge process once edge has been started (optional)")
+	flag.IntVar(&healthCheckDuration, "healthCheckDuration", 30, "number of seconds edge must stay running after an upgrade for the upgrade to succeed (optional)")
+	flag.IntVar(&healthCheckInterval, "healthCheckInterval", 5, "number of seconds between edge health checks (optional)")
+	flag.StringVar(&healthCheckURL, "healthCheckURL", "", "URL that must respond with a 2xx status once edge has been upgraded (optional)")
+	flag.StringVar(&concurrencyPolicy, "concurrencyPolicy", concurrencyPolicyReject, "how requests received while edge is being modified are handled, 'reject' or 'queue' (optional)")
+	flag.IntVar(&maxQueuedRequests, "maxQueuedRequests", 5, "maximum number of requests queued when concurrencyPolicy is 'queue' (optional)")
+	flag.StringVar(&stateDir, "stateDir", "/var/lib/updateEdgeAdapter", "directory the adapter keeps its deployment journal in (optional)")
+	flag.BoolVar(&publishLogHistory, "publishLogHistory", false, "publish all of the log events of a request with each new event, rather than only the new event (optional)")
+	flag.IntVar(&progressInterval, "progressInterval", 10, "minimum number of seconds between download progress events (optional)")
+	flag.Float64Var(&progressPercentStep, "progressPercentStep", 5, "minimum percentage a download must advance by between download progress events (optional)")
+	flag.IntVar(&downloadRetries, "downloadRetries", 5, "number of times a failed download is retried, resuming from the data already received (optional)")
+	flag.IntVar(&downloadBackoff, "downloadBackoff", 2, "number of seconds before the first download retry, doubling with each retry (optional)")
+	flag.IntVar(&freeSpaceMargin, "freeSpaceMargin", 10, "megabytes of free disk space to leave, in addition to the space needed by an upgrade (optional)")
+	flag.StringVar(&stagingDir, "stagingDir", "/tmp", "directory edge archives are downloaded to (optional)")
+	flag.StringVar(&caBundle, "caBundle", "", "PEM encoded CA bundle used, in addition to the system roots, to verify the download server certificate (optional)")
+	flag.StringVar(&clientCert, "clientCert", "", "PEM encoded client certificate presented to the download server (optional)")
+	flag.StringVar(&clientKey, "clientKey", "", "PEM encoded private key of the client certificate (optional)")
+	flag.StringVar(&trustedKeysFile, "trustedKeysFile", "", "file containing the ed25519 public keys trusted to sign edge archives, one per line or PEM encoded (optional)")
 }
 
 func usage() {
@@ -92,6 +163,24 @@ func validateFlags() {
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	if concurrencyPolicy != concurrencyPolicyReject && concurrencyPolicy != concurrencyPolicyQueue {
+		log.Printf("ERROR - Invalid concurrencyPolicy %s\n\n", concurrencyPolicy)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if initSystemFlag != "" && findServiceManager(initSystemFlag) == nil {
+		log.Printf("ERROR - Unsupported initSystem %s\n\n", initSystemFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if _, err := parseEdgeMode(); err != nil {
+		log.Printf("ERROR - Invalid edgeMode %s\n\n", edgeMode)
+		flag.Usage()
+		os.Exit(1)
+	}
 }
 
 func main() {
@@ -108,7 +197,7 @@ func main() {
 		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"},
 		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
 		Writer: &lumberjack.Logger{
-			Filename:   "/var/log/updateEdgeAdapter",
+			Filename:   adapterLogFile,
 			MaxSize:    1, // megabytes
 			MaxBackups: 5,
 			MaxAge:     10, //days
@@ -136,6 +225,15 @@ func main() {
 		os.Exit(-1)
 	}
 
+	//Edge will not be running if the adapter was interrupted while upgrading it
+	loadInterruptedJournal()
+	if edgeId == "" && interruptedJournal != nil {
+		log.Printf("[INFO] Edge is not running, using edge ID %s from the deployment journal\n", interruptedJournal.EdgeId)
+		edgeId = interruptedJournal.EdgeId
+	}
+	removeStaleStagingDirs()
+	removeStaleInstallFiles()
+
 	if edgeId == "" {
 		log.Println("Unable to retrieve edge ID, edge is not running. Exiting.")
 		os.Exit(-1)
@@ -146,8 +244,22 @@ func main() {
 		os.Exit(-1)
 	}
 
-	// Initialize ClearBlade Client
+	// Load the keys used to verify edge archive signatures
 	var err error
+	if trustedKeys, err = loadTrustedKeys(); err != nil {
+		log.Println(err.Error())
+		log.Println("Unable to load trusted keys. Exiting.")
+		os.Exit(-1)
+	}
+
+	// Initialize the HTTP client used to download edge
+	if err = initHTTPClient(); err != nil {
+		log.Println(err.Error())
+		log.Println("Unable to initialize HTTP client. Exiting.")
+		os.Exit(-1)
+	}
+
+	// Initialize ClearBlade Client
 	if err = initCbClient(cbBroker); err != nil {
 		log.Println(err.Error())
 		log.Println("Unable to initialize CB broker client. Exiting.")
@@ -172,6 +284,7 @@ func main() {
 func initializeVariables() {
 	architecture = getArchitecture()
 	initSystem = getInitSystem()
+	serviceManager = newServiceManager(initSystem)
 	edgeId = getEdgeId()
 
 	switch architecture {
@@ -249,6 +362,9 @@ func OnConnect(client mqtt.Client) {
 
 	//Start subscribe worker
 	go subscribeWorker()
+
+	//Finish any deployment interrupted by a crash or reboot now that the outcome can be published
+	recoverOnce.Do(recoverInterruptedDeployment)
 }
 
 func subscribeWorker() {
@@ -272,9 +388,24 @@ func subscribeWorker() {
 func handleRequest(payload []byte) {
 	log.Printf("[DEBUG] handleRequest - Json payload received: %s\n", string(payload))
 
-	deployLogs = make([]string, 0)
-
-	go deployEdge(payload)
+	jsonPayload, action, err := parseRequest(payload)
+	switch {
+	case err != nil:
+		go publishResult(jsonPayload)
+	case action.modifiesEdge:
+		//Only one deployment may modify edge at a time
+		deployments.submit(&deployment{
+			requestId:   jsonPayload["requestId"].(string),
+			payload:     payload,
+			jsonPayload: jsonPayload,
+			action:      action,
+		})
+	default:
+		go func() {
+			action.handle(context.Background(), jsonPayload)
+			publishResult(jsonPayload)
+		}()
+	}
 }
 
 func getEdgeId() string {
@@ -298,34 +429,6 @@ func getArchitecture() string {
 	return ""
 }
 
-func getInitSystem() string {
-	//Check if monit is being used
-	if isUsingMonit() {
-		return initSysTypeMonit
-	}
-
-	//May not be foolproof, but will work for now
-	log.Println("[DEBUG] getInitSystem - Executing command: ps -p 1")
-	psOutput, err := executeOSCommand("ps", []string{"-p", "1"})
-	if err == nil {
-		if strings.Contains(psOutput.(string), initSysTypeInitd) {
-			if isUsingInitd() {
-				log.Println("[DEBUG] getInitSystem - init system is init.d")
-				return initSysTypeInitd
-			}
-		} else if strings.Contains(psOutput.(string), initSysTypeSystemd) {
-			if isUsingSystemd() {
-				log.Println("[DEBUG] getInitSystem - init system is system.d")
-				return initSysTypeSystemd
-			}
-		}
-		return ""
-	}
-
-	log.Printf("[ERROR] getInitSystem - ERROR retrieving init system: %s\n", err.Error())
-	return ""
-}
-
 func isUsingInitd() bool {
 	log.Printf("[DEBUG] isUsingInitd - Executing command: find /etc/init.d -name %s\n", serviceName)
 	findOutput, err := executeOSCommand("find", []string{"/etc/init.d", "-name", serviceName})
@@ -386,187 +489,202 @@ func isUsingMonit() bool {
 	return false
 }
 
-func deployEdge(payload []byte) {
-	var err error
-	var jsonPayload map[string]interface{}
+func deployEdge(d *deployment) {
+	startDeployLog(d.requestId)
+	addLogEntry(fmt.Sprintf("Update Edge request payload received: %s\n", d.payload))
 
-	addLogEntry(fmt.Sprintf("Update Edge request payload received: %s\n", payload))
+	d.action.handle(d.ctx, d.jsonPayload)
 
-	if err := json.Unmarshal(payload, &jsonPayload); err != nil {
-		log.Printf("[ERROR] deployEdge - Error encountered unmarshalling json: %s\n", err.Error())
-		addErrorToPayload(jsonPayload, "Error encountered unmarshalling json: "+err.Error())
+	if d.ctx.Err() != nil && !d.committed {
+		//Cancelled before edge was stopped, remove anything left behind by the download
+		removeDownload(archivePath())
+		d.jsonPayload["cancelled"] = true
+		addErrorToPayload(d.jsonPayload, "Request cancelled, edge was not modified")
+	}
+	publishResult(d.jsonPayload)
+}
+
+// Sets the success attribute and publishes the response to a request
+func publishResult(jsonPayload map[string]interface{}) {
+	if jsonPayload["error"] == nil {
+		jsonPayload["success"] = true
 	} else {
-		log.Printf("[DEBUG] deployEdge - Json payload received: %#v\n", jsonPayload)
+		jsonPayload["success"] = false
 	}
 
-	if jsonPayload["version"] == nil {
-		log.Println("[ERROR] deployEdge - version not specified in incoming payload")
+	publishResponse(jsonPayload)
+}
+
+// Downloads, verifies and installs the requested version of edge, rolling back to the
+// previously installed edge if the upgrade fails
+func upgradeEdge(ctx context.Context, jsonPayload map[string]interface{}) {
+	var err error
+
+	if manager, ok := serviceManager.(*dockerManager); ok {
+		upgradeEdgeContainer(ctx, manager, jsonPayload)
+		return
+	}
+
+	if _, ok := jsonPayload["version"].(string); !ok {
+		log.Println("[ERROR] upgradeEdge - version not specified in incoming payload")
 		addErrorToPayload(jsonPayload, "The version attribute is required")
+	} else if err = validateVersion(jsonPayload["version"].(string)); err != nil {
+		log.Printf("[ERROR] upgradeEdge - Invalid version in incoming payload: %s\n", jsonPayload["version"])
+		addErrorToPayload(jsonPayload, err.Error())
 	} else {
 		var version = jsonPayload["version"].(string)
+		var sources []artifactSource
+		var source artifactSource
+		var backup *edgeBackup
+		var stageDir, binary string
+		defer func() { removeStagingDir(stageDir) }()
 		//Download Edge
-		log.Printf("[DEBUG] deployEdge - Downloading ClearBlade Edge version %s\n", version)
-		if err = downloadEdge(version); err != nil {
+		log.Printf("[DEBUG] upgradeEdge - Downloading ClearBlade Edge version %s\n", version)
+		if sources, err = getArtifactSources(version, jsonPayload); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered determining download source: "+err.Error())
+		} else if source, err = downloadEdge(ctx, version, sources); err != nil {
 			addErrorToPayload(jsonPayload, "Error encountered downloading edge: "+err.Error())
+		} else if err = verifyEdgeChecksum(ctx, source, jsonPayload); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered verifying edge checksum: "+err.Error())
+		} else if err = verifyEdgeSignature(ctx, source, jsonPayload); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered verifying edge signature: "+err.Error())
+		} else if stageDir, err = createStagingDir(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered preparing to install edge: "+err.Error())
+		} else if binary, err = preflightChecks(version, stageDir); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered in pre-flight checks, edge was not stopped: "+err.Error())
+		} else if backup, err = backupEdge(); err != nil {
+			addErrorToPayload(jsonPayload, "Error encountered backing up edge: "+err.Error())
+		} else if err = commitDeployment(ctx); err != nil {
+			removeFile(backup.path)
 		} else {
+			startJournal(jsonPayload, version, backup)
+			defer clearJournal()
+
 			//Stop Edge
-			log.Println("[DEBUG] deployEdge - Stopping Edge")
+			log.Println("[DEBUG] upgradeEdge - Stopping Edge")
 			if err = stopEdge(); err != nil {
 				addErrorToPayload(jsonPayload, "Error encountered stopping edge: "+err.Error())
 			} else {
 				//install Edge
-				log.Println("[DEBUG] deployEdge - Installing Edge")
-				if err = installEdge(version); err != nil {
+				setDeployPhase(phaseInstalling)
+				log.Println("[DEBUG] upgradeEdge - Installing Edge")
+				if err = installEdge(version, binary); err != nil {
 					addErrorToPayload(jsonPayload, "Error encountered installing edge: "+err.Error())
+				} else {
+					//Start Edge
+					setDeployPhase(phaseStarting)
+					log.Println("[DEBUG] upgradeEdge - Starting Edge")
+					if err = startEdge(); err != nil {
+						addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+					} else {
+						setDeployPhase(phaseVerifying)
+						if err = checkEdgeHealth(); err != nil {
+							addErrorToPayload(jsonPayload, "Error encountered verifying edge health: "+err.Error())
+						}
+					}
 				}
 
-				//Start Edge
-				log.Println("[DEBUG] deployEdge - Starting Edge")
-				if err = startEdge(); err != nil {
-					addErrorToPayload(jsonPayload, "Error encountered starting edge: "+err.Error())
+				if err == nil {
+					setInstalledVersion(version)
+					jsonPayload["runningVersion"] = version
+					pruneBackups()
+				} else {
+					//Restore the previous edge binary
+					log.Printf("[DEBUG] upgradeEdge - Rolling back to edge version %s\n", backup.version)
+					if err = rollbackEdge(backup); err != nil {
+						addErrorToPayload(jsonPayload, "Error encountered rolling back edge: "+err.Error())
+					} else {
+						jsonPayload["rolledBack"] = true
+						jsonPayload["runningVersion"] = backup.version
+					}
 				}
 			}
 		}
 	}
-
-	if jsonPayload["error"] == nil {
-		jsonPayload["success"] = true
-	} else {
-		jsonPayload["success"] = false
-	}
-
-	publishResponse(jsonPayload)
-	return
 }
 
 func stopEdge() error {
-	var err error
-
-	switch initSystem {
-	case initSysTypeInitd:
-		log.Printf("[DEBUG] stopEdge - Executing command: /etc/init.d/%s stop\n", serviceName)
-		addLogEntry(fmt.Sprintf("Stopping running edge from init.d: /etc/init.d/%s stop\n", serviceName))
-		_, err = executeOSCommand("/etc/init.d/"+serviceName, []string{"stop"})
-	case initSysTypeSystemd:
-		log.Printf("[DEBUG] stopEdge - Executing command: systemctl stop %s.service\n", serviceName)
-		addLogEntry(fmt.Sprintf("Stopping running edge from system.d: systemctl stop %s.service\n", serviceName))
-		_, err = executeOSCommand("systemctl", []string{"stop", serviceName + ".service"})
-	case initSysTypeMonit:
-		log.Printf("[DEBUG] stopEdge - Executing command: monit stop %s\n", serviceName)
-		addLogEntry(fmt.Sprintf("Stopping running edge from monit: monit stop %s\n", serviceName))
-		_, err = executeOSCommand("monit", []string{"stop", serviceName})
+	if serviceManager == nil {
+		log.Println("[ERROR] stopEdge - No supported init system manages edge")
+		return errors.New(noServiceManagerError)
 	}
-	if err != nil {
+
+	log.Printf("[DEBUG] stopEdge - Stopping edge with %s\n", serviceManager.Name())
+	if err := serviceManager.Stop(); err != nil {
 		log.Printf("[ERROR] stopEdge - ERROR stopping edge: %s\n", err.Error())
 		return err
 	}
+
+	//Some init systems, ex. monit, return before edge has exited
+	if err := waitForEdgeStop(); err != nil {
+		log.Printf("[ERROR] stopEdge - ERROR waiting for edge to stop: %s\n", err.Error())
+
+		//The init system was told to stop edge and would leave it down once it exits, so it is started again.
+		//The process manager already killed edge, the edge process still running is not one it can relaunch.
+		if _, ok := serviceManager.(*processManager); !ok {
+			addLogEvent(logLevelWarn, fmt.Sprintf("Edge did not exit after it was stopped, starting edge with %s again\n", serviceManager.Name()))
+			if startErr := serviceManager.Start(); startErr != nil {
+				log.Printf("[ERROR] stopEdge - ERROR starting edge again: %s\n", startErr.Error())
+				addLogEvent(logLevelError, "Error starting edge again: "+startErr.Error())
+			}
+		}
+		return err
+	}
 	addLogEntry(fmt.Sprintln("Edge stopped"))
 	return nil
 }
 
 func startEdge() error {
-	var err error
-
-	switch initSystem {
-	case initSysTypeInitd:
-		log.Printf("[DEBUG] startEdge - Executing command: /etc/init.d/%s start\n", serviceName)
-		addLogEntry(fmt.Sprintf("Starting edge from init.d: /etc/init.d/%s start", serviceName))
-		_, err = executeOSCommand("/etc/init.d/"+serviceName, []string{"start"})
-	case initSysTypeSystemd:
-		log.Printf("[DEBUG] startEdge - Executing command: systemctl start %s.service\n", serviceName)
-		addLogEntry(fmt.Sprintf("Starting edge from system.d: systemctl start %s.service\n", serviceName))
-		_, err = executeOSCommand("systemctl", []string{"start", serviceName + ".service"})
-	case initSysTypeMonit:
-		log.Printf("[DEBUG] startEdge - Executing command: monit start %s\n", serviceName)
-		addLogEntry(fmt.Sprintf("Starting edge from monit: monit start %s\n", serviceName))
-		_, err = executeOSCommand("monit", []string{"start", serviceName})
+	if serviceManager == nil {
+		log.Println("[ERROR] startEdge - No supported init system manages edge")
+		return errors.New(noServiceManagerError)
 	}
+
+	//An edge process still running before the start does not show that edge started
+	previous, err := getEdgeProcesses()
 	if err != nil {
-		log.Printf("[ERROR] startEdge - ERROR starting edge: %s\n", err.Error())
 		return err
 	}
-	addLogEntry(fmt.Sprintln("Edge started"))
-	return nil
-}
-
-func downloadEdge(version string) error {
-	var err error
-	//wget -q -O myEdge.tar.gz --no-check-certificate https://github.com/ClearBlade/Edge/releases/download/4.2.3/edge-linux-armv5tejl.tar.gz
-	url := "https://github.com/ClearBlade/Edge/releases/download/" + version + "/" + edgeDownloadName
-
-	addLogEntry(fmt.Sprintf("Downloading ClearBlade Edge version %s\n", version))
 
-	log.Printf("[DEBUG] downloadEdge - Executing command: wget -q -P /tmp/ --no-check-certificate %s\n", url)
-	if _, err = executeOSCommand("wget", []string{"-q", "-P", "/tmp/", "--no-check-certificate", url}); err != nil {
-		log.Printf("[ERROR] downloadEdge - ERROR downloading edge: %s\n", err.Error())
-		return errors.New("Error downloading edge binary: " + err.Error())
+	log.Printf("[DEBUG] startEdge - Starting edge with %s\n", serviceManager.Name())
+	if err = serviceManager.Start(); err != nil {
+		log.Printf("[ERROR] startEdge - ERROR starting edge: %s\n", err.Error())
+		return err
 	}
 
-	addLogEntry(fmt.Sprintf("ClearBlade Edge version %s downloaded from Github\n", version))
+	if err = waitForEdgeStart(previous); err != nil {
+		log.Printf("[ERROR] startEdge - ERROR waiting for edge to start: %s\n", err.Error())
+		return err
+	}
+	addLogEntry(fmt.Sprintln("Edge started"))
 	return nil
 }
 
-func installEdge(version string) error {
-	var cmdResp interface{}
-	var err error
-	var msg string
-
+// Installs the edge binary extracted from the downloaded archive during the pre-flight checks
+func installEdge(version string, binary string) error {
 	addLogEntry(fmt.Sprintln("Installing updated Edge..."))
 
-	//Un-tar binary
-	log.Printf("[DEBUG] installEdge - Executing command: tar xzvf %s\n", "/tmp/"+edgeDownloadName)
-	addLogEntry(fmt.Sprintf("Executing tar command on file %s\n", "/tmp/"+edgeDownloadName))
-
-	if cmdResp, err = executeOSCommand("tar", []string{"xzvf", "/tmp/" + edgeDownloadName}); err != nil {
-		msg = "Error encountered executing the tar command"
-	} else {
-		//Move binary to install location
-		log.Printf("[DEBUG] installEdge - Executing command: mv edge-%s %s\n", version, edgeInstallDir+"/edge")
-		addLogEntry(fmt.Sprintf("Moving binary to %s\n", edgeInstallDir))
-
-		if cmdResp, err = executeOSCommand("mv", []string{"edge-" + version, edgeInstallDir + "/edge"}); err != nil {
-			msg = "Error encountered moving edge binary to " + edgeInstallDir
-		} else {
-			//chgrp on binary
-			log.Printf("[DEBUG] installEdge - Executing command: chgrp root %s\n", edgeInstallDir+"/edge")
-			addLogEntry(fmt.Sprintf("Changing the ownership group to root: chgrp root %s\n", edgeInstallDir+"/edge"))
-
-			if cmdResp, err = executeOSCommand("chgrp", []string{"root", edgeInstallDir + "/edge"}); err != nil {
-				msg = "Error encountered changing the ownership group to root"
-			} else {
-				//chown on binary
-				log.Printf("[DEBUG] installEdge - Executing command: chown root %s\n", edgeInstallDir+"/edge")
-				addLogEntry(fmt.Sprintf("Changing the owner to root: chown root %s\n", edgeInstallDir+"/edge"))
-
-				if cmdResp, err = executeOSCommand("chown", []string{"root", edgeInstallDir + "/edge"}); err != nil {
-					msg = "Error encountered changing the owner to root"
-				} else {
-					//chmod on binary
-					log.Printf("[DEBUG] installEdge - Executing command: chmod +x %s\n", edgeInstallDir+"/edge")
-					addLogEntry(fmt.Sprintf("Changing permissions: chmod +x %s\n", edgeInstallDir+"/edge"))
+	uid, gid, mode, err := lookupEdgeOwnership()
+	if err != nil {
+		return err
+	}
 
-					if cmdResp, err = executeOSCommand("chmod", []string{"+x", edgeInstallDir + "/edge"}); err != nil {
-						msg = "Error encountered changing permissions"
-					} else {
-						//Deleting downloaded file
-						log.Printf("[DEBUG] installEdge - Executing command: rm %s\n", "/tmp/"+edgeDownloadName)
-						addLogEntry(fmt.Sprintf("Deleting downloaded file: rm %s\n", "/tmp/"+edgeDownloadName))
+	//Replace the binary in a single rename so edge is never missing, partially written or not executable
+	log.Printf("[DEBUG] installEdge - Replacing %s with %s\n", edgeBinaryPath(), binary)
+	addLogEntry(fmt.Sprintf("Replacing %s, owned by %s:%s with mode %04o\n", edgeBinaryPath(), edgeOwner, edgeGroup, mode))
 
-						if cmdResp, err = executeOSCommand("rm", []string{"/tmp/" + edgeDownloadName}); err != nil {
-							msg = "Error encountered deleting " + "/tmp/" + edgeDownloadName
-						}
-					}
-				}
-			}
-		}
+	if err = replaceFile(binary, edgeBinaryPath(), uid, gid, mode); err != nil {
+		log.Printf("[ERROR] installEdge - ERROR replacing edge binary: %s\n", err.Error())
+		return errors.New("Error encountered replacing the edge binary: " + err.Error())
 	}
 
-	if err != nil {
-		errString := msg + ": " + err.Error() + "\n"
-		if cmdResp != nil {
-			errString = errString + "\nCommand Response: " + cmdResp.(string)
-		}
-		return errors.New(errString)
+	//Deleting downloaded file
+	log.Printf("[DEBUG] installEdge - Deleting %s\n", archivePath())
+	addLogEntry(fmt.Sprintf("Deleting downloaded file %s\n", archivePath()))
+
+	if err = os.Remove(archivePath()); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] installEdge - ERROR deleting %s: %s\n", archivePath(), err.Error())
+		return errors.New("Error encountered deleting " + archivePath() + ": " + err.Error())
 	}
 
 	addLogEntry(fmt.Sprintf("Edge version %s installed\n", version))
@@ -595,6 +713,11 @@ func addErrorToPayload(payload map[string]interface{}, errMsg string) {
 	} else {
 		payload["error"] = payload["error"].(string) + "\n" + errMsg
 	}
+
+	//Errors of the request modifying edge are also published on the logs topic
+	if isDeployRequest(payload) {
+		addLogEvent(logLevelError, errMsg)
+	}
 }
 
 // Subscribes to a topic
@@ -613,6 +736,9 @@ func subscribe(topic string) (<-chan *mqttTypes.Publish, error) {
 // Publishes data to a topic
 func publish(topic string, data string) error {
 	log.Printf("[DEBUG] publish - Publishing to topic %s\n", topic)
+	if cbBroker.client == nil {
+		return errors.New("Not connected to the ClearBlade platform")
+	}
 	error := cbBroker.client.Publish(topic, []byte(data), cbBroker.qos)
 	if error != nil {
 		log.Printf("[ERROR] publish - Unable to publish to topic: %s due to error: %s\n", topic, error.Error())
@@ -640,29 +766,3 @@ func publishResponse(respJson map[string]interface{}) {
 		}
 	}
 }
-
-func publishLogs() {
-	logsPayload := make(map[string]interface{})
-	logsPayload["logs"] = deployLogs
-
-	//Create the response topic
-	theTopic := topicRoot + "/" + edgeId + "/logs"
-
-	logsStr, err := json.Marshal(logsPayload)
-	if err != nil {
-		log.Printf("[ERROR] publishLogs - ERROR marshalling json response: %s\n", err.Error())
-	} else {
-		log.Printf("[DEBUG] publishLogs - Publishing logs %s to topic %s\n", string(logsStr), theTopic)
-
-		//Publish the logs
-		err = publish(theTopic, string(logsStr))
-		if err != nil {
-			log.Printf("[ERROR] publishLogs - ERROR publishing to topic: %s\n", err.Error())
-		}
-	}
-}
-
-func addLogEntry(log string) {
-	deployLogs = append(deployLogs, log)
-	publishLogs()
-}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	sourceTypeBucket      = "bucket"
+	sourceTypeCodeService = "codeService"
+	defaultBucketBox      = "outbox"
+)
+
+// Fetches artifacts from a ClearBlade platform bucket set using the adapter's device credentials.
+// The path may contain the {version}, {arch} and {file} placeholders. A path without {file} is the
+// path of the archive itself, other artifacts are then read from the same directory.
+type bucketSource struct {
+	bucketSet string
+	box       string
+	path      string
+	version   string
+}
+
+func (s bucketSource) filePath(fileName string) string {
+	expanded := strings.NewReplacer("{version}", s.version, "{arch}", architecture, "{file}", fileName).Replace(s.path)
+	if strings.Contains(s.path, "{file}") || fileName == edgeDownloadName {
+		return expanded
+	}
+	return path.Join(path.Dir(expanded), fileName)
+}
+
+func (s bucketSource) fetch(ctx context.Context, fileName string, destPath string) error {
+	filePath := s.filePath(fileName)
+	url := fmt.Sprintf("%s/api/v/4/bucket_sets/%s/%s/file/read", strings.TrimSuffix(platformURL, "/"), sysKey, s.bucketSet)
+	log.Printf("[DEBUG] bucketSource.fetch - Reading %s from box %s of bucket set %s\n", filePath, s.box, s.bucketSet)
+
+	body, err := json.Marshal(map[string]interface{}{"box": s.box, "path": filePath})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("ClearBlade-UserToken", cbBroker.client.DeviceToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.New("Error reading " + filePath + " from bucket set " + s.bucketSet + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Error reading %s from bucket set %s: unexpected HTTP status %s: %s", filePath, s.bucketSet, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	//The platform returns the file contents either as raw bytes or base64 encoded within a json object
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return errors.New("Error decoding bucket set response: " + err.Error())
+		}
+		return writeBase64File(result, destPath)
+	}
+	return writeFile(resp.Body, destPath)
+}
+
+func (s bucketSource) String() string {
+	return "bucket set " + s.bucketSet + " (" + s.box + "/" + s.filePath(edgeDownloadName) + ")"
+}
+
+// Fetches artifacts from a ClearBlade platform code service using the adapter's device credentials.
+// The service is invoked with the version, arch and file parameters and must return the base64
+// encoded contents of the requested file.
+type codeServiceSource struct {
+	service string
+	version string
+}
+
+func (s codeServiceSource) fetch(ctx context.Context, fileName string, destPath string) error {
+	log.Printf("[DEBUG] codeServiceSource.fetch - Invoking code service %s for %s\n", s.service, fileName)
+
+	params := map[string]interface{}{
+		"version": s.version,
+		"arch":    architecture,
+		"file":    fileName,
+	}
+	resp, err := cbBroker.client.CallService(sysKey, s.service, params, false)
+	if err != nil {
+		return errors.New("Error invoking code service " + s.service + ": " + err.Error())
+	}
+	//The SDK does not support cancelling service calls, discard the results instead
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if success, ok := resp["success"].(bool); ok && !success {
+		return fmt.Errorf("Code service %s failed: %v", s.service, resp["results"])
+	}
+
+	return writeBase64File(resp, destPath)
+}
+
+func (s codeServiceSource) String() string {
+	return "code service " + s.service
+}
+
+// Parses the source attribute of the request payload, used to download edge from the ClearBlade platform
+func getPlatformSource(version string, source map[string]interface{}) (artifactSource, error) {
+	sourceType, _ := source["type"].(string)
+
+	switch sourceType {
+	case sourceTypeBucket:
+		bucketSet, _ := source["bucketSet"].(string)
+		filePath, _ := source["path"].(string)
+		box, _ := source["box"].(string)
+		if bucketSet == "" || filePath == "" {
+			return nil, errors.New("The bucketSet and path attributes are required for bucket sources")
+		}
+		if box == "" {
+			box = defaultBucketBox
+		}
+		return bucketSource{bucketSet: bucketSet, box: box, path: filePath, version: version}, nil
+	case sourceTypeCodeService:
+		service, _ := source["service"].(string)
+		if service == "" {
+			return nil, errors.New("The service attribute is required for code service sources")
+		}
+		return codeServiceSource{service: service, version: version}, nil
+	default:
+		return nil, errors.New("Unsupported source type '" + sourceType + "', expected '" + sourceTypeBucket + "' or '" + sourceTypeCodeService + "'")
+	}
+}
+
+// Decodes base64 file contents returned by the platform and writes them to destPath
+func writeBase64File(result map[string]interface{}, destPath string) error {
+	encoded := base64Contents(result)
+	if encoded == "" {
+		return errors.New("No file contents returned")
+	}
+
+	return writeFile(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)), destPath)
+}
+
+// Finds the base64 encoded file contents within a platform response. The contents may be a string or
+// nested within the results, contents or data attribute of an object.
+func base64Contents(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"results", "contents", "data"} {
+			if contents := base64Contents(v[key]); contents != "" {
+				return contents
+			}
+		}
+	}
+	return ""
+}
+
+// Writes the contents of reader to destPath. Nothing is left at destPath on failure.
+func writeFile(reader io.Reader, destPath string) error {
+	file, err := os.Create(destPath)
+	if err != nil {
+		return errors.New("Error creating " + destPath + ": " + err.Error())
+	}
+
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeFile(destPath)
+		return errors.New("Error writing " + destPath + ": " + err.Error())
+	}
+	return nil
+}
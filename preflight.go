@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const binaryExecTimeout = 10 * time.Second
+
+// Verifies the upgrade can succeed before edge is stopped, so that a failure leaves the running edge untouched.
+// The archive is extracted into stageDir and the path of the new edge binary is returned.
+func preflightChecks(version string, stageDir string) (string, error) {
+	setDeployPhase(phasePreflight)
+	addLogEntry(fmt.Sprintln("Running pre-flight checks"))
+
+	if serviceManager == nil {
+		return "", errors.New(noServiceManagerError)
+	}
+
+	contentsSize, err := archiveSize(archivePath())
+	if err != nil {
+		return "", err
+	}
+	addLogEntry(fmt.Sprintf("Archive %s is intact\n", edgeDownloadName))
+
+	if err = checkInstallDirWritable(); err != nil {
+		return "", err
+	}
+
+	if _, _, _, err = lookupEdgeOwnership(); err != nil {
+		return "", err
+	}
+
+	if err = checkFreeSpace(contentsSize); err != nil {
+		return "", err
+	}
+
+	log.Printf("[DEBUG] preflightChecks - Extracting %s to %s\n", archivePath(), stageDir)
+	if err = extractArchive(archivePath(), stageDir); err != nil {
+		return "", err
+	}
+	binary, err := findEdgeBinary(stageDir, version)
+	if err != nil {
+		return "", err
+	}
+	addLogEntry(fmt.Sprintf("Extracted edge binary %s from %s\n", filepath.Base(binary), edgeDownloadName))
+
+	if err = os.Chmod(binary, 0755); err != nil {
+		return "", errors.New("Error making " + binary + " executable: " + err.Error())
+	}
+	if err = checkBinaryExecutes(binary); err != nil {
+		return "", err
+	}
+
+	addLogEntry(fmt.Sprintln("Pre-flight checks passed"))
+	return binary, nil
+}
+
+// Verifies the adapter can create files in the edge install directory
+func checkInstallDirWritable() error {
+	testFile, err := os.CreateTemp(edgeInstallDir, ".updateEdgeAdapter")
+	if err != nil {
+		return errors.New("Edge install directory " + edgeInstallDir + " is not writable: " + err.Error())
+	}
+	testFile.Close()
+	removeFile(testFile.Name())
+
+	addLogEntry(fmt.Sprintf("Edge install directory %s is writable\n", edgeInstallDir))
+	return nil
+}
+
+// Verifies there is room for the extracted archive in the staging and install directories and for
+// the backup of the installed binary. Directories on the same file system share the free space.
+func checkFreeSpace(contentsSize int64) error {
+	var currentSize int64
+	if info, err := os.Stat(edgeBinaryPath()); err == nil {
+		currentSize = info.Size()
+	}
+
+	type fileSystem struct {
+		dirs      []string
+		required  uint64
+		available uint64
+	}
+	fileSystems := map[uint64]*fileSystem{}
+	margin := uint64(freeSpaceMargin) << 20
+
+	for _, check := range []struct {
+		dir  string
+		size int64
+	}{
+		{stagingDir, contentsSize},
+		{edgeInstallDir, contentsSize},
+		{getBackupDir(), currentSize},
+	} {
+		dir := check.dir
+		//The backup directory is created by the upgrade if it does not exist yet
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dir = filepath.Dir(dir)
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Stat(dir, &stat); err != nil {
+			return errors.New("Error checking free space in " + dir + ": " + err.Error())
+		}
+		fs, ok := fileSystems[uint64(stat.Dev)]
+		if !ok {
+			var statfs syscall.Statfs_t
+			if err := syscall.Statfs(dir, &statfs); err != nil {
+				return errors.New("Error checking free space in " + dir + ": " + err.Error())
+			}
+			fs = &fileSystem{required: margin, available: uint64(statfs.Bavail) * uint64(statfs.Bsize)}
+			fileSystems[uint64(stat.Dev)] = fs
+		}
+		fs.dirs = append(fs.dirs, check.dir)
+		fs.required += uint64(check.size)
+	}
+
+	for _, fs := range fileSystems {
+		if fs.available < fs.required {
+			return fmt.Errorf("Insufficient free space for %s: %s required, %s available", strings.Join(fs.dirs, ", "), formatBytes(int64(fs.required)), formatBytes(int64(fs.available)))
+		}
+		log.Printf("[DEBUG] checkFreeSpace - %s: %d bytes required, %d bytes available\n", strings.Join(fs.dirs, ", "), fs.required, fs.available)
+	}
+
+	addLogEntry(fmt.Sprintln("Sufficient free disk space is available"))
+	return nil
+}
+
+// Verifies an edge binary runs on this CPU by executing it with --version. Failing to execute it, or it being
+// killed by a signal such as SIGILL, fails the check. A non-zero exit status does not, older releases may not
+// support --version.
+func checkBinaryExecutes(binary string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), binaryExecTimeout)
+	defer cancel()
+
+	log.Printf("[DEBUG] checkBinaryExecutes - Executing command: %s --version\n", binary)
+	output, err := exec.CommandContext(ctx, binary, "--version").CombinedOutput()
+
+	if ctx.Err() != nil {
+		//It ran until it was killed, so it is executable on this CPU
+		log.Printf("[DEBUG] checkBinaryExecutes - %s --version did not exit within %s\n", binary, binaryExecTimeout)
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return fmt.Errorf("Edge binary %s was killed by signal %s, it is not compatible with this CPU", binary, status.Signal())
+		}
+		log.Printf("[DEBUG] checkBinaryExecutes - %s --version exited with %s\n", binary, err.Error())
+	} else if err != nil {
+		return errors.New("Edge binary " + binary + " cannot be executed on this gateway: " + err.Error())
+	}
+
+	addLogEntry(fmt.Sprintf("Edge binary %s executes on this gateway: %s\n", filepath.Base(binary), strings.TrimSpace(firstLine(string(output)))))
+	return nil
+}
+
+func firstLine(text string) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
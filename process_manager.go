@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	initSysTypeProcess  = "process"
+	edgeCommandFile     = "edge_command.json"
+	edgeOutputFile      = "edge.log"
+	processPollInterval = 500 * time.Millisecond
+)
+
+// The command line, environment and working directory of an edge process that was not started
+// by an init system, recorded so that edge can be relaunched the same way
+type edgeCommand struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+}
+
+// A ServiceManager for edge started by hand or from rc.local. Edge is stopped with signals and
+// relaunched with the command line captured from /proc before it was stopped.
+type processManager struct{}
+
+func newProcessManager() ServiceManager {
+	return &processManager{}
+}
+
+// Edge runs unmanaged when the adapter last started it, or when the edge process was reparented to
+// init, ex. started with nohup or from rc.local, and is not part of a systemd service. Edge supervised
+// by an init system that was not detected must not be controlled directly, as the init system would
+// start a second edge, so any other edge process requires the initSystem flag to be set to process.
+func isUsingProcess() bool {
+	if _, err := os.Stat(edgeCommandPath()); err == nil {
+		log.Printf("[DEBUG] isUsingProcess - Edge was last started by the adapter from %s\n", edgeCommandPath())
+		return true
+	}
+
+	processes, err := getEdgeProcesses()
+	if err != nil || len(processes) == 0 {
+		return false
+	}
+	for _, process := range processes {
+		if reason := getProcessSupervisor(process.pid); reason != "" {
+			log.Printf("[ERROR] isUsingProcess - Edge process %d may be supervised, %s. Set the initSystem flag to %s if edge is not supervised.\n", process.pid, reason, initSysTypeProcess)
+			return false
+		}
+	}
+	log.Println("[DEBUG] isUsingProcess - Edge is running without an init system")
+	return true
+}
+
+// Returns why the process may be supervised, or an empty string when it is verifiably unmanaged
+func getProcessSupervisor(pid int) string {
+	parentPid, err := readParentPid(pid)
+	if err != nil {
+		return "its parent process could not be determined: " + err.Error()
+	}
+	if parentPid != 1 {
+		return fmt.Sprintf("it was started by process %d (%s)", parentPid, readProcessName(parentPid))
+	}
+
+	//Services started by systemd also have init as their parent
+	if isInitProcess(initSysTypeSystemd) {
+		if unit := readSystemdUnit(pid); strings.HasSuffix(unit, ".service") && unit != "rc-local.service" {
+			return "it belongs to systemd unit " + unit
+		}
+	}
+	return ""
+}
+
+// Reads the parent process ID from /proc/<pid>/stat. The process name, in parentheses, may contain spaces.
+func readParentPid(pid int) (int, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("Unexpected contents of /proc/%d/stat", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+func readProcessName(pid int) string {
+	name, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(name))
+}
+
+// Returns the systemd unit, ex. edge.service or session-1.scope, the process belongs to
+func readSystemdUnit(pid int) string {
+	contents, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		//Unified hierarchy (0::<path>) or the systemd hierarchy of cgroup v1 (1:name=systemd:<path>)
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || (parts[1] != "" && parts[1] != "name=systemd") {
+			continue
+		}
+		components := strings.Split(parts[2], "/")
+		for i := len(components) - 1; i >= 0; i-- {
+			if strings.HasSuffix(components[i], ".service") || strings.HasSuffix(components[i], ".scope") {
+				return components[i]
+			}
+		}
+	}
+	return ""
+}
+
+func edgeCommandPath() string {
+	return filepath.Join(stateDir, edgeCommandFile)
+}
+
+func (m *processManager) Name() string {
+	return initSysTypeProcess
+}
+
+// Captures the command line of the running edge and stops it with SIGTERM, escalating to SIGKILL
+// when edge has not exited within stopTimeout seconds
+func (m *processManager) Stop() error {
+	processes, err := getEdgeProcesses()
+	if err != nil {
+		return err
+	}
+	if len(processes) == 0 {
+		addLogEntry(fmt.Sprintln("Edge is not running"))
+		return nil
+	}
+
+	command, err := captureEdgeCommand(processes[0].pid)
+	if err != nil {
+		return err
+	}
+	if err = writeEdgeCommand(command); err != nil {
+		return errors.New("Error recording the edge command line: " + err.Error())
+	}
+	log.Printf("[DEBUG] Stop - Captured edge command: %s\n", strings.Join(command.Args, " "))
+	if command.Path != edgeBinaryPath() {
+		log.Printf("[WARN] Stop - Edge is running from %s rather than %s\n", command.Path, edgeBinaryPath())
+		addLogEvent(logLevelWarn, fmt.Sprintf("Edge is running from %s, which is not replaced by upgrades of %s\n", command.Path, edgeBinaryPath()))
+	}
+
+	for _, process := range processes {
+		addLogEntry(fmt.Sprintf("Sending SIGTERM to edge process %d\n", process.pid))
+		if err = syscall.Kill(process.pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Error sending SIGTERM to edge process %d: %s", process.pid, err.Error())
+		}
+	}
+
+	timeout := time.Duration(stopTimeout) * time.Second
+	for _, process := range processes {
+		if waitForProcessExit(process.pid, timeout) {
+			continue
+		}
+		addLogEvent(logLevelWarn, fmt.Sprintf("Edge process %d did not exit within %s, sending SIGKILL\n", process.pid, timeout))
+		if err = syscall.Kill(process.pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Error sending SIGKILL to edge process %d: %s", process.pid, err.Error())
+		}
+		if !waitForProcessExit(process.pid, timeout) {
+			return fmt.Errorf("Edge process %d did not exit after SIGKILL", process.pid)
+		}
+	}
+	return nil
+}
+
+// Relaunches edge in its own session, with the command line, environment and working directory
+// captured when it was stopped. Under systemd, edge is launched in its own scope so that it is not
+// killed along with the control group of the adapter's service when the adapter stops or restarts.
+func (m *processManager) Start() error {
+	command, err := readEdgeCommand()
+	if err != nil {
+		return err
+	}
+
+	//Edge output is appended to a file, as the original stdout and stderr are not known
+	output, err := os.OpenFile(filepath.Join(stateDir, edgeOutputFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("Error opening edge output file: " + err.Error())
+	}
+	defer output.Close()
+
+	path, args := getEdgeLaunchCommand(command)
+	cmd := &exec.Cmd{
+		Path:        path,
+		Args:        args,
+		Env:         command.Env,
+		Dir:         command.Dir,
+		Stdout:      output,
+		Stderr:      output,
+		SysProcAttr: &syscall.SysProcAttr{Setsid: true},
+	}
+
+	log.Printf("[DEBUG] Start - Executing command: %s\n", strings.Join(args, " "))
+	addLogEntry(fmt.Sprintf("Launching edge: %s\n", strings.Join(command.Args, " ")))
+	if err = cmd.Start(); err != nil {
+		return errors.New("Error launching edge: " + err.Error())
+	}
+	addLogEntry(fmt.Sprintf("Edge launched with process ID %d\n", cmd.Process.Pid))
+
+	//Reap edge when it exits, it is reparented to init if the adapter exits first
+	go cmd.Wait()
+	return nil
+}
+
+// Returns the executable and arguments launching the edge command, within a transient systemd scope
+// when systemd is the init system. systemd-run executes edge itself, so edge keeps the environment
+// and working directory of the command.
+func getEdgeLaunchCommand(command *edgeCommand) (string, []string) {
+	if !isInitProcess(initSysTypeSystemd) {
+		return command.Path, command.Args
+	}
+
+	systemdRun, err := exec.LookPath("systemd-run")
+	if err != nil {
+		log.Printf("[WARN] getEdgeLaunchCommand - systemd-run not found: %s\n", err.Error())
+		addLogEvent(logLevelWarn, "systemd-run not found, edge will be stopped along with the adapter unless the adapter's systemd unit sets KillMode=process\n")
+		return command.Path, command.Args
+	}
+	args := []string{systemdRun, "--scope", "--quiet", "--description=ClearBlade Edge", "--", command.Path}
+	return systemdRun, append(args, command.Args[1:]...)
+}
+
+func (m *processManager) Restart() error {
+	if err := m.Stop(); err != nil {
+		return err
+	}
+	return m.Start()
+}
+
+func (m *processManager) Status() (string, error) {
+	processes, err := getEdgeProcesses()
+	if err != nil {
+		return "", err
+	}
+	if len(processes) == 0 {
+		return "stopped", nil
+	}
+	return fmt.Sprintf("running (pid %d)", processes[0].pid), nil
+}
+
+func (m *processManager) IsActive() (bool, error) {
+	return isEdgeProcessRunning()
+}
+
+// Reads the executable, command line, environment and working directory of a process from /proc
+func captureEdgeCommand(pid int) (*edgeCommand, error) {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	cmdline, err := os.ReadFile(filepath.Join(procDir, "cmdline"))
+	if err != nil {
+		return nil, errors.New("Error reading the edge command line: " + err.Error())
+	}
+	environ, err := os.ReadFile(filepath.Join(procDir, "environ"))
+	if err != nil {
+		return nil, errors.New("Error reading the edge environment: " + err.Error())
+	}
+	dir, err := os.Readlink(filepath.Join(procDir, "cwd"))
+	if err != nil {
+		return nil, errors.New("Error reading the edge working directory: " + err.Error())
+	}
+	path, err := os.Readlink(filepath.Join(procDir, "exe"))
+	if err != nil {
+		return nil, errors.New("Error reading the edge executable: " + err.Error())
+	}
+
+	command := &edgeCommand{
+		//The executable is replaced by the upgrade, so it is resolved now rather than from argv[0]
+		Path: strings.TrimSuffix(path, " (deleted)"),
+		Args: splitNulSeparated(cmdline),
+		Env:  splitNulSeparated(environ),
+		Dir:  dir,
+	}
+	if len(command.Args) == 0 {
+		return nil, fmt.Errorf("Edge process %d has an empty command line", pid)
+	}
+	return command, nil
+}
+
+func splitNulSeparated(contents []byte) []string {
+	values := []string{}
+	for _, value := range bytes.Split(contents, []byte{0}) {
+		if len(value) > 0 {
+			values = append(values, string(value))
+		}
+	}
+	return values
+}
+
+// Returns whether the process exited within timeout
+func waitForProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		//Signal 0 only checks whether the process exists
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processPollInterval)
+	}
+}
+
+func writeEdgeCommand(command *edgeCommand) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	contents, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+
+	//The environment may contain secrets, so the file is only readable by the adapter
+	tmpPath := edgeCommandPath() + ".tmp"
+	if err = os.WriteFile(tmpPath, contents, 0600); err != nil {
+		removeFile(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, edgeCommandPath())
+}
+
+func readEdgeCommand() (*edgeCommand, error) {
+	contents, err := os.ReadFile(edgeCommandPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("The edge command line has not been captured, edge must be running when it is first stopped by the adapter")
+		}
+		return nil, errors.New("Error reading " + edgeCommandPath() + ": " + err.Error())
+	}
+
+	var command edgeCommand
+	if err = json.Unmarshal(contents, &command); err != nil {
+		return nil, errors.New("Error parsing " + edgeCommandPath() + ": " + err.Error())
+	}
+	if command.Path == "" || len(command.Args) == 0 {
+		return nil, errors.New(edgeCommandPath() + " does not contain an edge command line")
+	}
+	return &command, nil
+}
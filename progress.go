@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The progress of a download, published in the progress attribute of log events
+type downloadProgress struct {
+	File          string  `json:"file"`
+	BytesReceived int64   `json:"bytesReceived"`
+	TotalBytes    int64   `json:"totalBytes"`
+	Percent       float64 `json:"percent"`
+	//Estimated seconds remaining, -1 when unknown
+	SecondsRemaining int64 `json:"secondsRemaining"`
+}
+
+// An io.Writer that counts the bytes written to a download and publishes progress events, at most
+// every progressInterval seconds and only once the download has advanced by progressPercentStep
+// percent. A total of -1 means the size of the download is unknown.
+type progressReporter struct {
+	file          string
+	total         int64
+	received      int64
+	startReceived int64
+	started       time.Time
+	lastPublished time.Time
+	lastPercent   float64
+	published     bool
+}
+
+func newProgressReporter(file string, received int64, total int64) *progressReporter {
+	now := time.Now()
+	return &progressReporter{
+		file:          file,
+		total:         total,
+		received:      received,
+		startReceived: received,
+		started:       now,
+		lastPublished: now,
+		lastPercent:   percentOf(received, total),
+	}
+}
+
+func (p *progressReporter) Write(data []byte) (int, error) {
+	p.received += int64(len(data))
+
+	now := time.Now()
+	if now.Sub(p.lastPublished) < time.Duration(progressInterval)*time.Second {
+		return len(data), nil
+	}
+
+	//Without a total size, progress can only be reported periodically
+	percent := percentOf(p.received, p.total)
+	if p.total > 0 && percent-p.lastPercent < progressPercentStep {
+		return len(data), nil
+	}
+
+	p.publish(now, percent)
+	return len(data), nil
+}
+
+// Publishes a final event once the download completes, if progress was reported while it ran
+func (p *progressReporter) finish() {
+	if p.published {
+		p.publish(time.Now(), percentOf(p.received, p.total))
+	}
+}
+
+func (p *progressReporter) publish(now time.Time, percent float64) {
+	p.lastPublished = now
+	p.lastPercent = percent
+	p.published = true
+
+	progress := &downloadProgress{
+		File:             p.file,
+		BytesReceived:    p.received,
+		TotalBytes:       p.total,
+		Percent:          percent,
+		SecondsRemaining: -1,
+	}
+
+	//Estimate the time remaining from the average rate of this download
+	elapsed := now.Sub(p.started).Seconds()
+	if p.total > 0 && elapsed > 0 && p.received > p.startReceived {
+		rate := float64(p.received-p.startReceived) / elapsed
+		progress.SecondsRemaining = int64(float64(p.total-p.received) / rate)
+	}
+
+	if p.total > 0 {
+		addProgressEvent(fmt.Sprintf("Downloaded %s of %s (%.0f%%) of %s", formatBytes(p.received), formatBytes(p.total), percent, p.file), progress)
+	} else {
+		addProgressEvent(fmt.Sprintf("Downloaded %s of %s", formatBytes(p.received), p.file), progress)
+	}
+}
+
+func percentOf(received int64, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(received) * 100 / float64(total)
+}
+
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+const noServiceManagerError = "No supported init system manages edge, specify one with the initSystem flag"
+
+// Controls the edge service through the init system or supervisor that manages it
+type ServiceManager interface {
+	//Name returns the name of the init system, as accepted by the initSystem flag
+	Name() string
+	Start() error
+	Stop() error
+	Restart() error
+	//Status returns the status of the edge service as reported by the init system
+	Status() (string, error)
+	IsActive() (bool, error)
+}
+
+// A ServiceManager implementation and how to detect that it manages edge on this gateway
+type serviceManagerRegistration struct {
+	name   string
+	detect func() bool
+	create func() ServiceManager
+}
+
+// The supported init systems, in the order they are detected in
+var serviceManagers = []serviceManagerRegistration{
+	{initSysTypeDocker, isUsingDocker, newDockerManager},
+	{initSysTypeMonit, isUsingMonit, newMonitManager},
+	{initSysTypeSupervisord, isUsingSupervisord, newSupervisordManager},
+	{initSysTypeRunit, isUsingRunit, newRunitManager},
+	{initSysTypeS6, isUsingS6, newS6Manager},
+	//OpenRC services are init.d scripts, so OpenRC is detected before init.d
+	{initSysTypeOpenRC, isUsingOpenRC, newOpenRCManager},
+	{initSysTypeInitd, func() bool { return isInitProcess(initSysTypeInitd) && isUsingInitd() }, newInitdManager},
+	{initSysTypeSystemd, func() bool { return isInitProcess(initSysTypeSystemd) && isUsingSystemd() }, newSystemdManager},
+	//Edge running without any of the above is controlled directly
+	{initSysTypeProcess, isUsingProcess, newProcessManager},
+}
+
+func getServiceManagerNames() []string {
+	names := make([]string, 0, len(serviceManagers))
+	for _, registration := range serviceManagers {
+		names = append(names, registration.name)
+	}
+	return names
+}
+
+func findServiceManager(name string) *serviceManagerRegistration {
+	for i := range serviceManagers {
+		if serviceManagers[i].name == name {
+			return &serviceManagers[i]
+		}
+	}
+	return nil
+}
+
+// Returns the init system specified by the initSystem flag or, when not specified, the first
+// registered init system detected as managing edge
+func getInitSystem() string {
+	if initSystemFlag != "" {
+		log.Printf("[DEBUG] getInitSystem - init system %s specified by the initSystem flag\n", initSystemFlag)
+		return initSystemFlag
+	}
+
+	for _, registration := range serviceManagers {
+		if registration.detect() {
+			log.Printf("[DEBUG] getInitSystem - init system is %s\n", registration.name)
+			return registration.name
+		}
+	}
+
+	log.Printf("[ERROR] getInitSystem - Unable to detect the init system managing edge, supported init systems are %s\n", strings.Join(getServiceManagerNames(), ", "))
+	return ""
+}
+
+// Returns the ServiceManager of the named init system, or nil when the init system is not supported
+func newServiceManager(name string) ServiceManager {
+	if registration := findServiceManager(name); registration != nil {
+		return registration.create()
+	}
+	return nil
+}
+
+// Returns whether the name of the process with PID 1 contains name
+func isInitProcess(name string) bool {
+	//May not be foolproof, but will work for now
+	log.Println("[DEBUG] isInitProcess - Executing command: ps -p 1")
+	psOutput, err := executeOSCommand("ps", []string{"-p", "1"})
+	if err != nil {
+		log.Printf("[ERROR] isInitProcess - ERROR retrieving init process: %s\n", err.Error())
+		return false
+	}
+	return strings.Contains(psOutput.(string), name)
+}
+
+// A ServiceManager that controls edge by running a command, such as systemctl, for each action
+type commandServiceManager struct {
+	name string
+	//description is how the init system is referred to in log messages
+	description string
+	//command returns the command line performing the action
+	command  func(action string) []string
+	isActive func() (bool, error)
+}
+
+func newInitdManager() ServiceManager {
+	return &commandServiceManager{
+		name:        initSysTypeInitd,
+		description: "init.d",
+		command: func(action string) []string {
+			return []string{"/etc/init.d/" + serviceName, action}
+		},
+		//LSB init scripts exit with 0 from status when the service is running
+		isActive: func() (bool, error) {
+			return commandSucceeds("/etc/init.d/"+serviceName, "status")
+		},
+	}
+}
+
+func newSystemdManager() ServiceManager {
+	return &commandServiceManager{
+		name:        initSysTypeSystemd,
+		description: "system.d",
+		command: func(action string) []string {
+			return []string{"systemctl", action, serviceName + ".service"}
+		},
+		isActive: func() (bool, error) {
+			return commandSucceeds("systemctl", "is-active", "--quiet", serviceName+".service")
+		},
+	}
+}
+
+func newMonitManager() ServiceManager {
+	return &commandServiceManager{
+		name:        initSysTypeMonit,
+		description: "monit",
+		command: func(action string) []string {
+			return []string{"monit", action, serviceName}
+		},
+		//The output of monit status differs between monit versions, check for the edge process instead
+		isActive: isEdgeProcessRunning,
+	}
+}
+
+func (m *commandServiceManager) Name() string {
+	return m.name
+}
+
+func (m *commandServiceManager) Start() error {
+	return m.run("start")
+}
+
+func (m *commandServiceManager) Stop() error {
+	return m.run("stop")
+}
+
+func (m *commandServiceManager) Restart() error {
+	return m.run("restart")
+}
+
+func (m *commandServiceManager) Status() (string, error) {
+	cmd := m.command("status")
+	return commandOutput(cmd[0], cmd[1:]...)
+}
+
+func (m *commandServiceManager) IsActive() (bool, error) {
+	return m.isActive()
+}
+
+func (m *commandServiceManager) run(action string) error {
+	cmd := m.command(action)
+	log.Printf("[DEBUG] run - Executing command: %s\n", strings.Join(cmd, " "))
+	addLogEntry(fmt.Sprintf("Executing %s command: %s\n", m.description, strings.Join(cmd, " ")))
+
+	if _, err := executeOSCommand(cmd[0], cmd[1:]); err != nil {
+		return errors.New("Error executing " + strings.Join(cmd, " ") + ": " + err.Error())
+	}
+	return nil
+}
+
+// Returns the output of a command. Status commands exit with an error when the service is not
+// running, so a non-zero exit status is not treated as an error.
+func commandOutput(name string, args ...string) (string, error) {
+	log.Printf("[DEBUG] commandOutput - Executing command: %s %s\n", name, strings.Join(args, " "))
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		return "", errors.New("Error executing " + name + ": " + err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Returns whether a command exits successfully, treating a non-zero exit status as false
+func commandSucceeds(name string, args ...string) (bool, error) {
+	log.Printf("[DEBUG] commandSucceeds - Executing command: %s %s\n", name, strings.Join(args, " "))
+	err := exec.Command(name, args...).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func isEdgeProcessRunning() (bool, error) {
+	processes, err := getEdgeProcesses()
+	if err != nil {
+		return false, err
+	}
+	return len(processes) > 0, nil
+}
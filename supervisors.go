@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	initSysTypeRunit       = "runit"
+	initSysTypeOpenRC      = "openrc"
+	initSysTypeS6          = "s6"
+	initSysTypeSupervisord = "supervisord"
+)
+
+var (
+	//Directories runsvdir supervises services in
+	runitServiceDirs = []string{"/etc/service", "/var/service", "/service"}
+	//Scan directories of s6-svscan, including those used by s6-overlay
+	s6ServiceDirs = []string{"/run/service", "/var/run/s6/services", "/service"}
+)
+
+func newRunitManager() ServiceManager {
+	dir := findServiceDir(runitServiceDirs)
+	return &commandServiceManager{
+		name:        initSysTypeRunit,
+		description: "runit",
+		command: func(action string) []string {
+			return []string{"sv", action, dir}
+		},
+		isActive: func() (bool, error) {
+			//sv status prints "run: <dir>: (pid 123) 45s" while the service is up
+			output, err := commandOutput("sv", "status", dir)
+			return strings.HasPrefix(output, "run:"), err
+		},
+	}
+}
+
+func newOpenRCManager() ServiceManager {
+	return &commandServiceManager{
+		name:        initSysTypeOpenRC,
+		description: "OpenRC",
+		command: func(action string) []string {
+			return []string{"rc-service", serviceName, action}
+		},
+		isActive: func() (bool, error) {
+			return commandSucceeds("rc-service", serviceName, "status")
+		},
+	}
+}
+
+func newS6Manager() ServiceManager {
+	dir := findServiceDir(s6ServiceDirs)
+	return &commandServiceManager{
+		name:        initSysTypeS6,
+		description: "s6",
+		command: func(action string) []string {
+			switch action {
+			case "start":
+				return []string{"s6-svc", "-u", dir}
+			case "stop":
+				return []string{"s6-svc", "-d", dir}
+			case "restart":
+				//Send SIGTERM and bring the service up again, even if it was down
+				return []string{"s6-svc", "-t", "-u", dir}
+			default:
+				return []string{"s6-svstat", dir}
+			}
+		},
+		isActive: func() (bool, error) {
+			//s6-svstat prints "up (pid 123) 45 seconds" while the service is up
+			output, err := commandOutput("s6-svstat", dir)
+			return strings.HasPrefix(output, "up"), err
+		},
+	}
+}
+
+func newSupervisordManager() ServiceManager {
+	return &commandServiceManager{
+		name:        initSysTypeSupervisord,
+		description: "supervisord",
+		command: func(action string) []string {
+			return []string{"supervisorctl", action, serviceName}
+		},
+		isActive: func() (bool, error) {
+			output, err := commandOutput("supervisorctl", "status", serviceName)
+			return strings.Contains(output, "RUNNING"), err
+		},
+	}
+}
+
+func isUsingRunit() bool {
+	if !isProcessRunning("runsvdir") {
+		return false
+	}
+	return hasServiceDir(runitServiceDirs)
+}
+
+func isUsingOpenRC() bool {
+	//OpenRC records its state in /run/openrc once booted
+	if _, err := os.Stat("/run/openrc"); err != nil {
+		return false
+	}
+	return isUsingInitd()
+}
+
+func isUsingS6() bool {
+	if !isProcessRunning("s6-svscan") {
+		return false
+	}
+	return hasServiceDir(s6ServiceDirs)
+}
+
+func isUsingSupervisord() bool {
+	if !isProcessRunning("supervisord") {
+		return false
+	}
+
+	output, err := commandOutput("supervisorctl", "status", serviceName)
+	if err != nil {
+		log.Printf("[ERROR] isUsingSupervisord - ERROR invoking 'supervisorctl status' command: %s\n", err.Error())
+		return false
+	}
+	if strings.HasPrefix(output, serviceName) && !strings.Contains(output, "no such process") {
+		log.Println("[DEBUG] isUsingSupervisord - supervisord is managing edge")
+		return true
+	}
+	log.Println("[DEBUG] isUsingSupervisord - supervisord is not managing edge")
+	return false
+}
+
+func isProcessRunning(name string) bool {
+	log.Printf("[DEBUG] isProcessRunning - Executing command: ps -C %s\n", name)
+	//ps exits with an error when no processes match
+	_, err := executeOSCommand("ps", []string{"-C", name})
+	return err == nil
+}
+
+func hasServiceDir(scanDirs []string) bool {
+	for _, scanDir := range scanDirs {
+		if info, err := os.Stat(filepath.Join(scanDir, serviceName)); err == nil && info.IsDir() {
+			log.Printf("[DEBUG] hasServiceDir - '%s' service found in %s\n", serviceName, scanDir)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the directory of the edge service in the first scan directory containing it
+func findServiceDir(scanDirs []string) string {
+	for _, scanDir := range scanDirs {
+		dir := filepath.Join(scanDir, serviceName)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return filepath.Join(scanDirs[0], serviceName)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verifies the downloaded edge archive against the sha256 checksum specified in the
+// request payload or, when none was provided, the checksum manifest published with the release
+func verifyEdgeChecksum(ctx context.Context, source artifactSource, jsonPayload map[string]interface{}) error {
+	return verifyChecksum(ctx, source, jsonPayload, edgeDownloadName, archivePath())
+}
+
+// Verifies the downloaded artifact fileName, saved to archiveFile, against the sha256 checksum specified
+// in the request payload or the checksum manifest published with the release
+func verifyChecksum(ctx context.Context, source artifactSource, jsonPayload map[string]interface{}, fileName string, archiveFile string) error {
+	var expected string
+
+	setDeployPhase(phaseVerifyingArchive)
+
+	if jsonPayload["sha256"] != nil {
+		sum, ok := jsonPayload["sha256"].(string)
+		if !ok {
+			return errors.New("The sha256 attribute must be a string")
+		}
+		expected = sum
+		addLogEntry(fmt.Sprintf("Using sha256 checksum from request payload: %s\n", expected))
+	} else {
+		sum, err := getManifestChecksum(ctx, source, fileName)
+		var unavailable *manifestUnavailableError
+		if err != nil && !errors.As(err, &unavailable) {
+			//A manifest that was published but does not vouch for the archive fails the upgrade
+			log.Printf("[ERROR] verifyChecksum - Invalid checksum manifest: %s\n", err.Error())
+			removeFile(archiveFile)
+			return errors.New("Invalid checksum manifest " + checksumManifest + ": " + err.Error())
+		}
+		if err != nil {
+			if requireChecksum {
+				removeFile(archiveFile)
+				return errors.New("Unable to retrieve checksum manifest: " + err.Error())
+			}
+			log.Printf("[WARN] verifyChecksum - Unable to retrieve checksum manifest, skipping verification: %s\n", err.Error())
+			addLogEvent(logLevelWarn, fmt.Sprintf("No checksum available for %s, skipping checksum verification\n", fileName))
+			return nil
+		}
+		expected = sum
+		addLogEntry(fmt.Sprintf("Using sha256 checksum from %s: %s\n", checksumManifest, expected))
+	}
+
+	actual, err := sha256File(archiveFile)
+	if err != nil {
+		log.Printf("[ERROR] verifyChecksum - ERROR computing checksum: %s\n", err.Error())
+		return errors.New("Error computing checksum of " + archiveFile + ": " + err.Error())
+	}
+
+	if !strings.EqualFold(actual, strings.TrimSpace(expected)) {
+		log.Printf("[ERROR] verifyChecksum - Checksum mismatch for %s: expected %s, got %s\n", archiveFile, expected, actual)
+		removeFile(archiveFile)
+		return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", fileName, expected, actual)
+	}
+
+	addLogEntry(fmt.Sprintf("Checksum of %s verified\n", fileName))
+	return nil
+}
+
+// The checksum manifest could not be downloaded, as opposed to a manifest without a valid entry for the file
+type manifestUnavailableError struct {
+	err error
+}
+
+func (e *manifestUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+// Downloads the checksum manifest for the release and returns the entry for fileName
+func getManifestChecksum(ctx context.Context, source artifactSource, fileName string) (string, error) {
+	manifestPath := filepath.Join(stagingDir, checksumManifest)
+
+	defer removeFile(manifestPath)
+
+	log.Printf("[DEBUG] getManifestChecksum - Retrieving %s from %s\n", checksumManifest, source)
+	if err := source.fetch(ctx, checksumManifest, manifestPath); err != nil {
+		return "", &manifestUnavailableError{err: err}
+	}
+
+	manifest, err := os.Open(manifestPath)
+	if err != nil {
+		return "", err
+	}
+	defer manifest.Close()
+
+	return parseChecksumManifest(manifest, fileName)
+}
+
+// Parses sha256sum formatted output ("<checksum>  <file name>") and returns the checksum of fileName
+func parseChecksumManifest(manifest io.Reader, fileName string) (string, error) {
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		//sha256sum prefixes the file name with '*' when the file was read in binary mode
+		if strings.TrimPrefix(fields[1], "*") == fileName {
+			if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+				return "", errors.New("Invalid checksum for " + fileName + " in manifest")
+			}
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New(fileName + " not found in checksum manifest")
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] removeFile - ERROR removing %s: %s\n", path, err.Error())
+	}
+}
+
+// Verifies the detached ed25519 signature of the downloaded edge archive against the trusted keys.
+// When trusted keys are configured, unsigned archives are rejected.
+func verifyEdgeSignature(ctx context.Context, source artifactSource, jsonPayload map[string]interface{}) error {
+	return verifySignature(ctx, source, jsonPayload, edgeDownloadName, archivePath())
+}
+
+// Verifies the detached ed25519 signature of the downloaded artifact fileName, saved to archiveFile
+func verifySignature(ctx context.Context, source artifactSource, jsonPayload map[string]interface{}, fileName string, archiveFile string) error {
+	if len(trustedKeys) == 0 {
+		log.Println("[DEBUG] verifySignature - No trusted keys configured, skipping signature verification")
+		return nil
+	}
+
+	var signature []byte
+	var err error
+
+	if jsonPayload["signature"] != nil {
+		sig, ok := jsonPayload["signature"].(string)
+		if !ok {
+			removeFile(archiveFile)
+			return errors.New("The signature attribute must be a string")
+		}
+		signature, err = decodeSignature([]byte(sig))
+		addLogEntry(fmt.Sprintln("Using signature from request payload"))
+	} else {
+		signature, err = getReleaseSignature(ctx, source, fileName)
+		addLogEntry(fmt.Sprintf("Using signature %s published with the release\n", fileName+signatureExtension))
+	}
+	if err != nil {
+		log.Printf("[ERROR] verifySignature - ERROR retrieving signature: %s\n", err.Error())
+		removeFile(archiveFile)
+		return errors.New("Unable to retrieve signature for " + fileName + ": " + err.Error())
+	}
+
+	archive, err := os.ReadFile(archiveFile)
+	if err != nil {
+		return errors.New("Error reading " + archiveFile + ": " + err.Error())
+	}
+
+	for i, key := range trustedKeys {
+		if ed25519.Verify(key, archive, signature) {
+			log.Printf("[DEBUG] verifySignature - Signature verified with trusted key %d\n", i)
+			addLogEntry(fmt.Sprintf("Signature of %s verified\n", fileName))
+			return nil
+		}
+	}
+
+	log.Printf("[ERROR] verifySignature - Signature of %s does not match any trusted key\n", archiveFile)
+	removeFile(archiveFile)
+	return errors.New("Signature of " + fileName + " does not match any trusted key")
+}
+
+// Downloads the detached signature published alongside fileName
+func getReleaseSignature(ctx context.Context, source artifactSource, fileName string) ([]byte, error) {
+	sigName := fileName + signatureExtension
+	sigPath := filepath.Join(stagingDir, sigName)
+
+	defer removeFile(sigPath)
+
+	log.Printf("[DEBUG] getReleaseSignature - Retrieving %s from %s\n", sigName, source)
+	if err := source.fetch(ctx, sigName, sigPath); err != nil {
+		return nil, err
+	}
+
+	contents, err := os.ReadFile(sigPath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSignature(contents)
+}
+
+// Accepts either a raw 64 byte ed25519 signature or its base64 encoding
+func decodeSignature(contents []byte) ([]byte, error) {
+	if len(contents) == ed25519.SignatureSize {
+		return contents, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, errors.New("Signature is not valid base64: " + err.Error())
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid ed25519 signature length %d", len(signature))
+	}
+	return signature, nil
+}
+
+// Parses the trusted public keys specified by the trustedKeys and trustedKeysFile flags.
+// Several keys may be trusted at once so that signing keys can be rotated.
+func loadTrustedKeys() ([]ed25519.PublicKey, error) {
+	var encodedKeys []string
+
+	for _, key := range strings.Split(trustedKeysFlag, ",") {
+		if strings.TrimSpace(key) != "" {
+			encodedKeys = append(encodedKeys, strings.TrimSpace(key))
+		}
+	}
+
+	if trustedKeysFile != "" {
+		contents, err := os.ReadFile(trustedKeysFile)
+		if err != nil {
+			return nil, errors.New("Error reading trusted keys file: " + err.Error())
+		}
+
+		//The file may contain PEM encoded keys or base64 encoded keys, one per line
+		if strings.Contains(string(contents), "-----BEGIN") {
+			for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+				key, err := parsePEMPublicKey(block)
+				if err != nil {
+					return nil, err
+				}
+				encodedKeys = append(encodedKeys, base64.StdEncoding.EncodeToString(key))
+			}
+		} else {
+			for _, line := range strings.Split(string(contents), "\n") {
+				line = strings.TrimSpace(line)
+				if line != "" && !strings.HasPrefix(line, "#") {
+					encodedKeys = append(encodedKeys, line)
+				}
+			}
+		}
+	}
+
+	keys := make([]ed25519.PublicKey, 0, len(encodedKeys))
+	for _, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("Trusted key is not valid base64: " + encoded)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Trusted key %s is not a %d byte ed25519 public key", encoded, ed25519.PublicKeySize)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+func parsePEMPublicKey(block *pem.Block) (ed25519.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Error parsing PEM encoded trusted key: " + err.Error())
+	}
+	key, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("PEM encoded trusted key is not an ed25519 public key")
+	}
+	return key, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testArchiveName     = "edge-linux-amd64.tar.gz"
+	testArchiveContents = "edge archive"
+)
+
+// An artifactSource serving files from memory. Files it does not have fail to download.
+type fakeSource map[string]string
+
+func (s fakeSource) fetch(ctx context.Context, fileName string, destPath string) error {
+	contents, ok := s[fileName]
+	if !ok {
+		return errors.New("404 Not Found")
+	}
+	return os.WriteFile(destPath, []byte(contents), 0644)
+}
+
+func (s fakeSource) String() string {
+	return "fake source"
+}
+
+func TestParseChecksumManifest(t *testing.T) {
+	checksum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name     string
+		manifest string
+		expected string
+		error    string
+	}{
+		{"entry", checksum + "  " + testArchiveName + "\n", checksum, ""},
+		{"binary mode entry", checksum + " *" + testArchiveName + "\n", checksum, ""},
+		{"among other entries", strings.Repeat("cd", 32) + "  edge-linux-arm64.tar.gz\n\n" + checksum + "  " + testArchiveName + "\n", checksum, ""},
+		{"no entry", checksum + "  edge-linux-arm64.tar.gz\n", "", "not found in checksum manifest"},
+		{"not hex", strings.Repeat("zz", 32) + "  " + testArchiveName + "\n", "", "Invalid checksum"},
+		{"short checksum", "abcd  " + testArchiveName + "\n", "", "Invalid checksum"},
+		{"empty", "", "", "not found in checksum manifest"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sum, err := parseChecksumManifest(strings.NewReader(test.manifest), testArchiveName)
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Errorf("error %v, expected %q", err, test.error)
+				}
+				return
+			}
+			if err != nil || sum != test.expected {
+				t.Errorf("checksum %q (%v), expected %q", sum, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksumManifest(t *testing.T) {
+	savedStagingDir, savedChecksumManifest, savedRequireChecksum := stagingDir, checksumManifest, requireChecksum
+	t.Cleanup(func() {
+		stagingDir, checksumManifest, requireChecksum = savedStagingDir, savedChecksumManifest, savedRequireChecksum
+	})
+	stagingDir = t.TempDir()
+	checksumManifest = "SHA256SUMS"
+
+	actual := sha256Of(t, testArchiveContents)
+	tests := []struct {
+		name            string
+		source          fakeSource
+		requireChecksum bool
+		error           string
+	}{
+		{name: "matching entry", source: fakeSource{"SHA256SUMS": actual + "  " + testArchiveName}},
+		{name: "mismatched entry", source: fakeSource{"SHA256SUMS": strings.Repeat("ab", 32) + "  " + testArchiveName}, error: "Checksum mismatch"},
+		{name: "no entry", source: fakeSource{"SHA256SUMS": actual + "  edge-linux-arm64.tar.gz"}, error: "Invalid checksum manifest"},
+		{name: "invalid entry", source: fakeSource{"SHA256SUMS": "not-a-checksum  " + testArchiveName}, error: "Invalid checksum manifest"},
+		{name: "missing manifest", source: fakeSource{}},
+		{name: "missing manifest required", source: fakeSource{}, requireChecksum: true, error: "Unable to retrieve checksum manifest"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requireChecksum = test.requireChecksum
+			archiveFile := filepath.Join(stagingDir, testArchiveName)
+			if err := os.WriteFile(archiveFile, []byte(testArchiveContents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := verifyChecksum(context.Background(), test.source, map[string]interface{}{}, testArchiveName, archiveFile)
+			if test.error == "" {
+				if err != nil {
+					t.Errorf("verification failed: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, expected %q", err, test.error)
+			}
+			if _, err = os.Stat(archiveFile); !os.IsNotExist(err) {
+				t.Error("the archive was not removed after failing verification")
+			}
+		})
+	}
+}
+
+func sha256Of(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "contents")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}